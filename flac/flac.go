@@ -3,9 +3,11 @@ package flac
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 
 	"github.com/mewkiz/flac/frame"
 	"github.com/mewkiz/flac/meta"
@@ -15,11 +17,17 @@ type Stream struct {
 	Info   *meta.StreamInfo
 	Blocks []*meta.Block
 	r      *bufio.Reader
+	rs     io.ReadSeeker
 	f      *os.File
 }
 
 var signature = []byte("fLaC")
 
+var errNotSeekable = errors.New("flac: underlying reader is not seekable")
+
+// metaMu serializes metadata parsing; meta.Parse uses a shared read buffer.
+var metaMu sync.Mutex
+
 func (stream *Stream) parseStreamInfo() (isLast bool, err error) {
 	r := stream.r
 	var buf [4]byte
@@ -46,6 +54,11 @@ func (stream *Stream) parseStreamInfo() (isLast bool, err error) {
 func Parse(r io.Reader) (stream *Stream, err error) {
 	br := bufio.NewReader(r)
 	stream = &Stream{r: br}
+	if rs, ok := r.(io.ReadSeeker); ok {
+		stream.rs = rs
+	}
+	metaMu.Lock()
+	defer metaMu.Unlock()
 	isLast, err := stream.parseStreamInfo()
 	if err != nil {
 		return nil, err
@@ -75,11 +88,19 @@ func ParseFile(path string) (stream *Stream, err error) {
 		return nil, err
 	}
 	stream, err = Parse(f)
+	if stream == nil {
+		f.Close()
+		return nil, err
+	}
 	stream.f = f
 	return stream, err
 }
 
+// Close closes the file opened by ParseFile.
 func (stream *Stream) Close() error {
+	if stream.f == nil {
+		return nil
+	}
 	return stream.f.Close()
 }
 
@@ -92,7 +113,31 @@ func (stream *Stream) ParseNext() (f *frame.Frame, err error) {
 }
 
 func (stream *Stream) Pos() (pos int64, err error) {
-	pos, err = stream.f.Seek(0, os.SEEK_CUR)
+	if stream.rs == nil {
+		return 0, errNotSeekable
+	}
+	pos, err = stream.rs.Seek(0, io.SeekCurrent)
 	pos -= int64(stream.r.Buffered())
 	return
 }
+
+// ReadAt reads len(p) bytes of the underlying reader starting at offset off.
+// It does not affect the parsing position of the stream.
+func (stream *Stream) ReadAt(p []byte, off int64) (n int, err error) {
+	if stream.rs == nil {
+		return 0, errNotSeekable
+	}
+	cur, err := stream.rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	_, err = stream.rs.Seek(off, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	n, err = io.ReadFull(stream.rs, p)
+	if _, serr := stream.rs.Seek(cur, io.SeekStart); err == nil {
+		err = serr
+	}
+	return n, err
+}
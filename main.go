@@ -1,597 +1,763 @@
 package main
 
 import (
-	"crypto/md5"
+	"errors"
 	"flag"
 	"fmt"
-	"hash"
-	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 
 	"github.com/mewkiz/flac/meta"
-	"github.com/sdidyk/flac2one/flac"
-	"github.com/sdidyk/flac2one/hashutil/crc16"
-	"github.com/sdidyk/flac2one/hashutil/crc8"
+	"github.com/sdidyk/flac2one/merge"
 )
 
 var flagSilent = flag.Bool("silent", false, "")
 var flagDelete = flag.Bool("delete", false, "")
 var flagOutputDir = flag.String("output", ".", "")
+var flagSplit = flag.Bool("split", false, "")
+var flagCueSheet = flag.Bool("cuesheet", false, "")
+var flagCueTags = flag.Bool("cuetags", false, "")
+var flagPregap = flag.String("pregap", "", "")
+var flagRound = flag.Bool("round", false, "")
+var flagExact = flag.Bool("exact", false, "")
+var flagChapters = flag.Bool("chapters", false, "")
+var flagDryRun = flag.Bool("dry-run", false, "")
+var flagGroup = flag.Bool("group", false, "")
+var flagRecursive = flag.Bool("recursive", false, "")
+var flagKeepOrder = flag.Bool("keep-order", false, "")
+var flagDiscs = flag.String("discs", "", "")
+var flagFast = flag.Bool("fast", false, "")
+var flagSeekTable = flag.String("seektable", "", "")
+var flagPictures = flag.String("pictures", "front", "")
+var flagCoverSize = flag.Int("cover-size", 0, "")
+var flagCoverQuality = flag.Int("cover-quality", 0, "")
+var flagKeepCover = flag.Bool("keep-cover", false, "")
+var flagExtractCover = flag.String("extract-cover", "", "")
+var flagPadding = flag.String("padding", "", "")
+var flagTagsFirst = flag.Bool("tags-first", false, "")
+
+// seekTable and padding are parsed from --seektable and --padding.
+var seekTable merge.SeekTable
+var padding merge.Padding
 
 func init() {
 	flag.BoolVar(flagSilent, "s", false, "")
 	flag.BoolVar(flagDelete, "d", false, "")
 	flag.StringVar(flagOutputDir, "o", ".", "")
+	flag.BoolVar(flagSplit, "x", false, "")
+	flag.BoolVar(flagCueSheet, "c", false, "")
+	flag.BoolVar(flagCueTags, "t", false, "")
+	flag.StringVar(flagPregap, "p", "", "")
+	flag.BoolVar(flagRound, "r", false, "")
+	flag.BoolVar(flagExact, "e", false, "")
+	flag.BoolVar(flagChapters, "j", false, "")
+	flag.BoolVar(flagDryRun, "n", false, "")
+	flag.BoolVar(flagGroup, "g", false, "")
+	flag.BoolVar(flagRecursive, "R", false, "")
+	flag.BoolVar(flagKeepOrder, "k", false, "")
+	flag.StringVar(flagDiscs, "D", "", "")
+	flag.BoolVar(flagFast, "f", false, "")
+	flag.StringVar(flagSeekTable, "S", "", "")
+	flag.StringVar(flagPictures, "P", "front", "")
+	flag.IntVar(flagCoverSize, "z", 0, "")
+	flag.IntVar(flagCoverQuality, "q", 0, "")
+	flag.BoolVar(flagKeepCover, "K", false, "")
+	flag.StringVar(flagExtractCover, "X", "", "")
+	flag.StringVar(flagPadding, "b", "", "")
+	flag.BoolVar(flagTagsFirst, "T", false, "")
 	flag.Usage = usage
 }
 
 func usage() {
 	fmt.Println("Usage: flac2one [options] <files>")
+	fmt.Println("       flac2one --recursive [options] <dirs>")
+	fmt.Println("       flac2one --split [options] <cue-files>")
+	fmt.Println("       flac2one [options] verify <flac-files>")
 	fmt.Println()
 	fmt.Println(`Options:
     -s, --silent        Silent mode
     -d, --delete        Delete input files after processing
-    -o, --output=DIR    Output directory (defaults to current dir)`)
+    -o, --output=DIR    Output directory (defaults to current dir)
+    -x, --split         Split FLAC image into tracks using CUE-sheet
+    -c, --cuesheet      Embed CUE-sheet into result flac file
+    -t, --cuetags       Embed CUE-sheet and track titles into tags
+    -p, --pregap=GLOB   Files with name matching GLOB are pregaps of next track
+    -r, --round         Round CUE-sheet times to nearest CD frame
+    -e, --exact         Fail if tracks do not start on CD frames
+    -j, --chapters      Write sample-accurate track positions to JSON file
+    -n, --dry-run       Check input files and print planned result only
+    -g, --group         Merge files into one result per format and album
+    -R, --recursive     Merge every album found in directories into output tree
+    -k, --keep-order    Keep order of files from command line instead of tags
+    -D, --discs=MODE    Multi-disc albums: one (single result), split (result
+                        per disc) or multi (result per disc, one CUE-sheet);
+                        defaults to split with --recursive, else one
+    -f, --fast          Do not decode audio; MD5 sum of result is unknown
+    -S, --seektable=SPEC
+                        Seek points, comma-separated as for metaflac
+                        --add-seekpoint: Ns (every N seconds of each track),
+                        N (at sample N), Nx (N points over the whole file),
+                        X (placeholder); also tracks (track starts only) and
+                        none (no seektable); defaults to 10s
+    -P, --pictures=MODE Pictures: front (front cover of first file), first
+                        (all of first file), all (of all files, duplicates
+                        removed), largest (largest front cover) or file
+                        (cover.jpg, folder.png etc. from input dir as front
+                        cover); defaults to front
+    -z, --cover-size=N  Downscale pictures to at most N pixels wide and high
+                        and re-encode them as JPEG
+    -q, --cover-quality=Q
+                        JPEG quality of re-encoded pictures (1-100, defaults
+                        to 90); re-encodes pictures without --cover-size too
+    -K, --keep-cover    Save original of re-encoded pictures next to result
+    -X, --extract-cover=NAME
+                        Save front cover to output dir as NAME with extension
+                        by its MIME type (e.g. cover or folder)
+    -b, --padding=SPEC  Padding: N (N bytes), align:N (round metadata up to
+                        a multiple of N bytes; both can be combined as
+                        N,align:M) or none; defaults to align:256
+    -T, --tags-first    Write tags right after STREAMINFO, before seektable
+                        and CUE-sheet`)
+	fmt.Println()
+	fmt.Println(`Exit codes:
+    0    Success
+    1    Invalid usage
+    2    Output file can not be written
+    3    Input file can not be read or parsed
+    4    Input files differ in sample rate, channels or bits per sample
+    5    Verification failed
+    6    Tracks do not start on CD frames (with --exact)
+    7    Picture can not be re-encoded
+    130  Interrupted`)
 	fmt.Println()
 }
 
-var first bool
-var blockSizeMin, blockSizeMax uint16
-var frameSizeMin, frameSizeMax uint32
-var sampleRate uint32
-var nChannels, bitsPerSample uint8
-var totalBytes, totalSamples, totalFrames uint64
-
-var seekTable []meta.SeekPoint
-var picture *meta.Block
-
-var tagAlbum, tagArtist, tagDate, tagGenre string
-var titles []struct {
-	string
-	uint64
+// exitCode returns the exit code for the typed errors of package merge, or
+// def for other errors.
+func exitCode(err error, def int) int {
+	var (
+		parseErr  *merge.InputParseError
+		formatErr *merge.FormatMismatchError
+		writeErr  *merge.OutputWriteError
+		verifyErr *merge.VerificationError
+	)
+	switch {
+	case errors.As(err, &formatErr):
+		return 4
+	case errors.As(err, &verifyErr):
+		return 5
+	case errors.As(err, &parseErr):
+		return 3
+	case errors.As(err, &writeErr):
+		return 2
+	}
+	return def
 }
-var filename string
-var rf, ro, rcue *os.File
-var md5sum hash.Hash
 
 func main() {
-	var err error
-
 	// flag parse and usage
 	flag.Parse()
+	handleSignals()
 	if flag.NArg() < 1 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	// create output file
-	rf, err = ioutil.TempFile(os.TempDir(), "flac2one")
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(2)
-	}
-	defer os.Remove(rf.Name())
-	defer rf.Close()
-
-	// read files
-	md5sum = md5.New()
-	seekTable = make([]meta.SeekPoint, 0, 1024)
-	titles = make(
-		[]struct {
-			string
-			uint64
-		},
-		0,
-		32,
-	)
-	first = true
-	for _, path := range flag.Args() {
-		if !*flagSilent {
-			fmt.Printf("Processing: %s\n", path)
+	if *flagSeekTable != "" {
+		var err error
+		seekTable, err = merge.ParseSeekTable(*flagSeekTable)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
-		err := list(path)
+	}
+	if *flagPadding != "" {
+		var err error
+		padding, err = merge.ParsePadding(*flagPadding)
 		if err != nil {
 			fmt.Println(err)
-			os.Exit(3)
+			os.Exit(1)
 		}
-		first = false
 	}
 
-	// generate file name
-	filename = fmt.Sprintf("%s/%s - %s", *flagOutputDir, quoteFilename(tagArtist), quoteFilename(tagAlbum))
-
-	if !*flagSilent {
-		fmt.Printf("Writing to \"%s.[flac|cue]\"\n", filename)
+	if flag.Arg(0) == "verify" {
+		if flag.NArg() < 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		os.Exit(verifyFiles(flag.Args()[1:]))
 	}
-
-	// write flac-file
-	ro, err = os.Create(fmt.Sprintf("%s.flac", filename))
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(2)
+	if *flagSplit {
+		if *flagDryRun {
+			fmt.Println("--dry-run is not supported with --split")
+			os.Exit(1)
+		}
+		os.Exit(splitFiles())
 	}
-	defer ro.Close()
+	os.Exit(mergeFiles())
+}
 
-	var b []byte
-	// STREAM: header
-	_, err = ro.Write([]byte("fLaC"))
-	if err != nil {
-		os.Exit(2)
-	}
-
-	// METADATA_BLOCK_HEADER: streaminfo
-	b = make([]byte, 4)
-	b[0] = byte(meta.TypeStreamInfo)
-	b[3] = 34
-	ro.Write(b)
-
-	// METADATA_BLOCK_STREAMINFO
-	b = make([]byte, 34)
-	b[0] = byte(blockSizeMin >> 8 & 255)
-	b[1] = byte(blockSizeMin & 255)
-	b[2] = byte(blockSizeMax >> 8 & 255)
-	b[3] = byte(blockSizeMax & 255)
-	b[4] = byte(frameSizeMin >> 16 & 255)
-	b[5] = byte(frameSizeMin >> 8 & 255)
-	b[6] = byte(frameSizeMin & 255)
-	b[7] = byte(frameSizeMax >> 16 & 255)
-	b[8] = byte(frameSizeMax >> 8 & 255)
-	b[9] = byte(frameSizeMax & 255)
-	b[10] = byte(sampleRate >> 12 & 255)
-	b[11] = byte(sampleRate >> 4 & 255)
-	b[12] = byte(sampleRate&15<<4) | byte((nChannels-1)<<1) | byte((bitsPerSample-1)>>4)
-	b[13] = byte((bitsPerSample-1)&15<<4) | byte(totalSamples>>32&255)
-	b[14] = byte(totalSamples >> 24 & 255)
-	b[15] = byte(totalSamples >> 16 & 255)
-	b[16] = byte(totalSamples >> 8 & 255)
-	b[17] = byte(totalSamples & 255)
-	copy(b[18:], md5sum.Sum(nil))
-	ro.Write(b)
-
-	if len(seekTable) > 0 {
-		// METADATA_BLOCK_HEADER: seektable
-		b = make([]byte, 4)
-		size := (8 + 8 + 2) * len(seekTable)
-		b[0] = byte(meta.TypeSeekTable)
-		b[1] = byte(size >> 16 & 255)
-		b[2] = byte(size >> 8 & 255)
-		b[3] = byte(size & 255)
-		ro.Write(b)
-
-		// METADATA_BLOCK_SEEKTABLE
-		b = make([]byte, 8+8+2)
-		for _, v := range seekTable {
-			b[0] = byte(v.SampleNum >> 56 & 255)
-			b[1] = byte(v.SampleNum >> 48 & 255)
-			b[2] = byte(v.SampleNum >> 40 & 255)
-			b[3] = byte(v.SampleNum >> 32 & 255)
-			b[4] = byte(v.SampleNum >> 24 & 255)
-			b[5] = byte(v.SampleNum >> 16 & 255)
-			b[6] = byte(v.SampleNum >> 8 & 255)
-			b[7] = byte(v.SampleNum & 255)
-			b[8] = byte(v.Offset >> 56 & 255)
-			b[9] = byte(v.Offset >> 48 & 255)
-			b[10] = byte(v.Offset >> 40 & 255)
-			b[11] = byte(v.Offset >> 32 & 255)
-			b[12] = byte(v.Offset >> 24 & 255)
-			b[13] = byte(v.Offset >> 16 & 255)
-			b[14] = byte(v.Offset >> 8 & 255)
-			b[15] = byte(v.Offset & 255)
-			b[16] = byte(v.NSamples >> 8 & 255)
-			b[17] = byte(v.NSamples & 255)
-			ro.Write(b)
-		}
-	}
-
-	if picture != nil {
-		// METADATA_BLOCK_HEADER: picture
-		b = make([]byte, 4)
-		b[0] = byte(meta.TypePicture)
-		b[1] = byte(picture.Length >> 16 & 255)
-		b[2] = byte(picture.Length >> 8 & 255)
-		b[3] = byte(picture.Length & 255)
-		ro.Write(b)
-
-		// METADATA_BLOCK_PICTURE
-		b = make([]byte, picture.Length)
-		picture := picture.Body.(*meta.Picture)
-		offset := 0
-		encUint32(b[offset:], picture.Type)
-		offset += 4
-		encUint32(b[offset:], uint32(len(picture.MIME)))
-		offset += 4
-		copy(b[offset:], picture.MIME)
-		offset += len(picture.MIME)
-		encUint32(b[offset:], uint32(len(picture.Desc)))
-		offset += 4
-		copy(b[offset:], picture.Desc)
-		offset += len(picture.Desc)
-		encUint32(b[offset:], picture.Width)
-		offset += 4
-		encUint32(b[offset:], picture.Height)
-		offset += 4
-		encUint32(b[offset:], picture.Depth)
-		offset += 4
-		encUint32(b[offset:], picture.NPalColors)
-		offset += 4
-		encUint32(b[offset:], uint32(len(picture.Data)))
-		offset += 4
-		copy(b[offset:], picture.Data)
-
-		ro.Write(b)
-	}
-
-	// METADATA_BLOCK_HEADER: padding
-	offset, err := ro.Seek(0, os.SEEK_CUR)
-	padding := 256 - (offset+4)&(256-1)
-	b = make([]byte, 4)
-	b[0] = 1<<7 | byte(meta.TypePadding)
-	b[3] = byte(padding)
-	ro.Write(b)
-	ro.Seek(padding, os.SEEK_CUR)
-
-	// copy frames
-	rf.Seek(0, os.SEEK_SET)
-	io.Copy(ro, rf)
+// album is a list of files merged into results in dir.
+type album struct {
+	dir   string
+	files []*merge.FileInfo
+}
 
-	// write cue-file
-	rcue, err = os.Create(fmt.Sprintf("%s.cue", filename))
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(2)
-	}
-	defer rcue.Close()
+func mergeFiles() int {
+	albums := []album{{dir: *flagOutputDir}}
 
-	if tagDate != "" {
-		rcue.Write([]byte(fmt.Sprintf("REM DATE %s\n", tagDate)))
+	switch *flagDiscs {
+	case "", "one", "split", "multi":
+	default:
+		fmt.Printf("invalid --discs mode %q\n", *flagDiscs)
+		return 1
 	}
-	if tagGenre != "" {
-		rcue.Write([]byte(fmt.Sprintf("REM GENRE %s\n", tagGenre)))
+	if _, ok := pictureModes[*flagPictures]; !ok {
+		fmt.Printf("invalid --pictures mode %q\n", *flagPictures)
+		return 1
 	}
-	rcue.Write([]byte(fmt.Sprintf("PERFORMER \"%s\"\n", quoteCue(tagArtist))))
-	rcue.Write([]byte(fmt.Sprintf("TITLE \"%s\"\n", quoteCue(tagAlbum))))
-	rcue.Write([]byte(fmt.Sprintf("FILE \"%s.flac\" WAVE\n", filename)))
-	for i, v := range titles {
-		rcue.Write([]byte(fmt.Sprintf("  TRACK %02d AUDIO\n", i+1)))
-		rcue.Write([]byte(fmt.Sprintf("    TITLE \"%s\"\n", quoteCue(v.string))))
-		rcue.Write([]byte(fmt.Sprintf("    INDEX 01 %s\n", samplesToTime(v.uint64))))
+	if *flagCoverSize < 0 || *flagCoverQuality < 0 || *flagCoverQuality > 100 {
+		fmt.Println("invalid --cover-size or --cover-quality")
+		return 1
 	}
 
-	// delete files
-	if *flagDelete {
+	switch {
+	// find albums in directories
+	case *flagRecursive:
+		albums = nil
+		for _, root := range flag.Args() {
+			list, skipped, err := merge.FindAlbums(root)
+			if err != nil {
+				fmt.Println(err)
+				return 3
+			}
+			for _, err := range skipped {
+				fmt.Printf("Warning: %v; albums in its directory skipped\n", err)
+			}
+			albums = append(albums, groupAlbums(list, root)...)
+		}
+
+	// group files by format and album
+	case *flagGroup:
+		list, err := merge.GroupFiles(flag.Args())
+		if err != nil {
+			fmt.Println(err)
+			return 3
+		}
+		albums = groupAlbums(list, "")
+
+	default:
 		for _, path := range flag.Args() {
-			err := os.Remove(path)
+			info, err := merge.ReadFileInfo(path)
 			if err != nil {
 				fmt.Println(err)
-				os.Exit(3)
+				return 3
 			}
+			albums[0].files = append(albums[0].files, info)
+		}
+
+		// order files by tags
+		if !*flagKeepOrder {
+			sortFiles(albums[0].files)
 		}
 	}
 
-	os.Exit(0)
+	var inputs []string
+	used := make(map[string]bool)
+	for _, a := range albums {
+		code := mergeAlbum(a, used)
+		if code != 0 {
+			return code
+		}
+		for _, info := range a.files {
+			inputs = append(inputs, info.Path)
+		}
+	}
+	if *flagDryRun {
+		return 0
+	}
+
+	// delete files
+	return deleteInputs(inputs)
 }
 
-func list(path string) (err error) {
-	// open file
-	stream, err := flac.ParseFile(path)
-	if err != nil {
-		return err
+// groupAlbums prints the groups and returns them as albums. Albums found
+// under root are placed into the same subdirectory of the output dir.
+func groupAlbums(groups []*merge.Group, root string) []album {
+	var albums []album
+	for _, g := range groups {
+		a := album{dir: *flagOutputDir, files: g.Files}
+		if root != "" {
+			rel, err := filepath.Rel(root, g.Dir)
+			if err == nil {
+				a.dir = filepath.Join(*flagOutputDir, rel)
+			}
+		}
+		if !*flagKeepOrder {
+			sortFiles(a.files)
+		}
+		if !*flagSilent {
+			fmt.Printf("Group %d: \"%s\" (%s)\n", len(albums)+1, g.Album, g.Format)
+			for _, info := range a.files {
+				fmt.Printf("  %s\n", info.Path)
+			}
+		}
+		albums = append(albums, a)
 	}
-	defer stream.Close()
+	return albums
+}
 
-	// check info
-	if first {
-		sampleRate = stream.Info.SampleRate
-		nChannels = stream.Info.NChannels
-		bitsPerSample = stream.Info.BitsPerSample
-		blockSizeMin = 65535
-		blockSizeMax = 0
-		frameSizeMin = 4294967295
-		frameSizeMax = 0
-	} else {
-		if sampleRate != stream.Info.SampleRate {
-			return fmt.Errorf("sample rate mismatch; expected %v, got %v", sampleRate, stream.Info.SampleRate)
+// sortFiles orders files by tags and warns about untagged, missing and
+// duplicated track numbers. Pregap files stay before the file following them.
+func sortFiles(files []*merge.FileInfo) {
+	for _, info := range files {
+		// a bad pattern is reported when the files are read
+		info.Pregap, _ = filepath.Match(*flagPregap, filepath.Base(info.Path))
+	}
+	for _, v := range merge.SortFiles(files) {
+		if *flagSilent {
+			continue
+		}
+		if v.Untagged() {
+			fmt.Printf("Warning: no track number in %s, kept before the next file\n", strings.Join(v.Paths, ", "))
+			continue
 		}
-		if nChannels != stream.Info.NChannels {
-			return fmt.Errorf("num of channels mismatch; expected %v, got %v", nChannels, stream.Info.NChannels)
+		track := fmt.Sprintf("track %02d", v.Track)
+		if v.Disc > 0 {
+			track = fmt.Sprintf("disc %d %s", v.Disc, track)
 		}
-		if bitsPerSample != stream.Info.BitsPerSample {
-			return fmt.Errorf("bits per sample mismatch; expected %v, got %v", bitsPerSample, stream.Info.BitsPerSample)
+		if v.Missing() {
+			fmt.Printf("Warning: %s is missing\n", track)
+		} else {
+			fmt.Printf("Warning: %s is duplicated: %s\n", track, strings.Join(v.Paths, ", "))
 		}
 	}
+}
 
-	// get meta
-	titles = append(
-		titles,
-		struct {
-			string
-			uint64
-		}{"", totalSamples},
-	)
-	for _, block := range stream.Blocks {
-		switch body := block.Body.(type) {
-		// tags: parse
-		case *meta.VorbisComment:
-			for _, tag := range body.Tags {
-				switch strings.ToUpper(tag[0]) {
-				case "ALBUM":
-					if first {
-						tagAlbum = tag[1]
-					}
-				case "ARTIST":
-					if first {
-						tagArtist = tag[1]
-					}
-				case "DATE":
-					if first {
-						tagDate = tag[1]
-					}
-				case "GENRE":
-					if first {
-						tagGenre = tag[1]
-					}
-				case "TITLE":
-					titles[len(titles)-1].string = tag[1]
-				}
+// mergeAlbum merges the files of a into one result, or into one result per
+// disc. Names in used are not taken for the results.
+func mergeAlbum(a album, used map[string]bool) int {
+	mode := *flagDiscs
+	if mode == "" && *flagRecursive {
+		mode = "split"
+	}
+	discs := [][]*merge.FileInfo{a.files}
+	if mode == "split" || mode == "multi" {
+		discs = merge.SplitDiscs(a.files)
+	}
+
+	// read files
+	var list []*merge.Merger
+	for _, files := range discs {
+		m, code := mergeDisc(files)
+		defer m.Close()
+		if code != 0 {
+			return code
+		}
+		if len(discs) > 1 && m.TotalDiscs < len(discs) {
+			m.TotalDiscs = len(discs)
+		}
+		list = append(list, m)
+	}
+
+	// generate file names
+	base := fmt.Sprintf("%s/%s - %s", a.dir, quoteFilename(list[0].Performer()), quoteFilename(list[0].Album))
+	var filenames []string
+	for i, m := range list {
+		filename := base
+		if len(list) > 1 {
+			disc := m.Disc
+			if disc == 0 {
+				disc = i + 1
 			}
+			filename = fmt.Sprintf("%s (CD%d)", base, disc)
+		}
+		name := filename
+		for i := 2; used[filename]; i++ {
+			filename = fmt.Sprintf("%s (%d)", name, i)
+		}
+		used[filename] = true
+		m.File = filepath.Base(filename) + ".flac"
+		filenames = append(filenames, filename)
+	}
 
-		case *meta.Picture:
-			// picture: save only Cover (front)
-			if first && picture == nil && body.Type == 3 {
-				picture = block
+	// re-encode pictures
+	originals := make([][]*meta.Picture, len(list))
+	if *flagCoverSize > 0 || *flagCoverQuality > 0 {
+		quality := *flagCoverQuality
+		if quality == 0 {
+			quality = 90
+		}
+		for i, m := range list {
+			var skipped []*meta.Picture
+			var err error
+			originals[i], skipped, err = m.ResizePictures(*flagCoverSize, quality)
+			if err != nil {
+				fmt.Println(err)
+				return 7
+			}
+			for _, pic := range skipped {
+				if !*flagSilent {
+					fmt.Printf("Warning: can not decode picture of type %s, kept unchanged\n", pic.MIME)
+				}
 			}
 		}
 	}
 
-	// get start offset
-	start, err := stream.Pos()
-	if err != nil {
-		return err
+	if *flagDryRun {
+		for i, m := range list {
+			printPlan(m, filenames[i])
+		}
+		return 0
 	}
 
-	// reopen file for copying
-	f, err := os.Open(path)
+	// create output dir
+	err := os.MkdirAll(a.dir, 0755)
 	if err != nil {
-		return err
+		fmt.Println(err)
+		return 2
 	}
-	defer f.Close()
 
-	// rewrite frames
-	frames := uint64(0)
-	samples := uint64(0)
-	lastSecIndex := uint64(0)
-	for {
-		var n int
-		offset := totalBytes
-		crcHeader := crc8.NewATM()
-		crcFrame := crc16.NewIBM()
+	// write to temporary files
+	var out outputs
+	defer out.cleanup()
+	multi := mode == "multi" && len(list) > 1
+	for i, m := range list {
+		code := writeResult(&out, m, filenames[i], !multi)
+		if code != 0 {
+			return code
+		}
+		if *flagKeepCover {
+			code = writePictures(&out, originals[i], filenames[i]+".orig")
+			if code != 0 {
+				return code
+			}
+		}
+	}
 
-		fr := io.TeeReader(f, crcHeader)
-		hr := io.TeeReader(fr, crcFrame)
+	// write cover
+	if pic := list[0].FrontCover(); *flagExtractCover != "" && pic != nil {
+		name := filepath.Join(a.dir, *flagExtractCover)
+		for i := 2; used[name]; i++ {
+			name = fmt.Sprintf("%s (%d)", filepath.Join(a.dir, *flagExtractCover), i)
+		}
+		used[name] = true
+		code := writePictures(&out, []*meta.Picture{pic}, name)
+		if code != 0 {
+			return code
+		}
+	}
 
-		frame, err := stream.ParseNext()
+	// write cue-file of all discs
+	if multi {
+		if !*flagSilent {
+			fmt.Printf("Writing to \"%s.cue\"\n", base)
+		}
+		var files []string
+		for _, filename := range filenames {
+			files = append(files, filepath.Base(filename)+".flac")
+		}
+		rcue, err := out.create(fmt.Sprintf("%s.cue", base))
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+			fmt.Println(err)
+			return 2
 		}
-		// update md5
-		frame.Hash(md5sum)
 
-		// get frame size
-		next, err := stream.Pos()
+		err = merge.WriteMultiCue(rcue, list, files)
 		if err != nil {
-			return err
-		}
-		size := next - start
-
-		// new sample number
-		oldNumSize := getUtf8Size(frame.Num)
-		newSampleNumber := encodeUtf8(samples + totalSamples)
-
-		// copy frame
-		// (header)
-		b := make([]byte, 4)
-		f.Seek(start, os.SEEK_SET)
-		f.Read(b)
-		// always variable block-size
-		b[1] |= 1
-		rf.Write(b)
-		totalBytes += 4
-		crcHeader.Write(b)
-		crcFrame.Write(b)
-
-		additionalBytes := int64(0)
-		// blocksize bits == 011x
-		if b[2]&0xE0 == 0x60 {
-			additionalBytes++
-			if b[2]&0x10>>4 != 0 {
-				additionalBytes++
-			}
-		}
-		// sample rate bits == 11xx
-		if b[2]&0x0C == 0x0C {
-			additionalBytes++
-			if b[2]&0x03 != 0 {
-				additionalBytes++
-			}
+			fmt.Println(err)
+			return 2
 		}
+	}
 
-		// (new frame number)
-		n, _ = rf.Write(newSampleNumber)
-		totalBytes += uint64(n)
-		crcHeader.Write(newSampleNumber)
-		crcFrame.Write(newSampleNumber)
-
-		// (additional bytes)
-		if additionalBytes > 0 {
-			f.Seek(start+4+oldNumSize, os.SEEK_SET)
-			io.CopyN(rf, hr, additionalBytes)
-			totalBytes += uint64(additionalBytes)
-		}
-
-		// (new crc8)
-		crc8s := crcHeader.Sum8()
-		n, _ = rf.Write([]byte{crc8s})
-		totalBytes++
-		crcFrame.Write([]byte{crc8s})
-
-		// (rest of frame)
-		restSize := size - (4 + oldNumSize + additionalBytes + 1) - 2
-		f.Seek(start+4+oldNumSize+additionalBytes+1, os.SEEK_SET)
-		io.CopyN(rf, hr, restSize)
-		totalBytes += uint64(restSize)
-
-		// (new crc16)
-		crc16s := crcFrame.Sum16()
-		rf.Write([]byte{byte(crc16s >> 8), byte(crc16s & 0xff)})
-		totalBytes += 2
-
-		// add seektable offset
-		// approx every 10 seconds of each track
-		sampleNum := samples + totalSamples
-		secIndex := samples / uint64(sampleRate) / 10
-		if samples == 0 || secIndex > lastSecIndex {
-			// do not repeat twice
-			if !(len(seekTable) > 0 && seekTable[len(seekTable)-1].SampleNum == sampleNum) {
-				seekTable = append(
-					seekTable,
-					meta.SeekPoint{
-						SampleNum: sampleNum,
-						Offset:    offset,
-						NSamples:  frame.BlockSize,
-					},
-				)
-				lastSecIndex = secIndex
+	// check results before deleting inputs
+	if *flagDelete {
+		for i, m := range list {
+			name := fmt.Sprintf("%s.flac", filenames[i])
+			err := checkResult(m, name, out.tempName(name))
+			if err != nil {
+				fmt.Println(err)
+				return exitCode(err, 5)
 			}
 		}
+	}
 
-		// recalculate new frame size
-		if oldNumSize < int64(len(newSampleNumber)) {
-			size += int64(len(newSampleNumber)) - oldNumSize
+	// move results into place
+	err = out.commit()
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	return 0
+}
+
+// errMismatch is returned by checkResult if the result differs from its
+// input files.
+var errMismatch = &merge.VerificationError{Frame: -1, Err: errors.New("result does not match input files; nothing deleted")}
+
+// checkResult compares the decoded result of m with its input files. The
+// result named name is read from path, its temporary name.
+func checkResult(m *merge.Merger, name, path string) error {
+	if !*flagSilent {
+		fmt.Printf("Checking \"%s\"\n", name)
+	}
+	results, err := m.CheckFile(path)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		input := res.Path
+		if input == "" {
+			input = name
 		}
-		// update min and max
-		if uint32(size) < frameSizeMin {
-			frameSizeMin = uint32(size)
+		switch {
+		case res.Samples != res.ExpectedSamples:
+			fmt.Printf("%s: %d samples in result, expected %d\n", input, res.Samples, res.ExpectedSamples)
+		case !res.OK():
+			fmt.Printf("%s: MD5 sum %x in result, expected %x\n", input, res.MD5, res.ExpectedMD5)
+		default:
+			continue
 		}
-		if uint32(size) > frameSizeMax {
-			frameSizeMax = uint32(size)
+		err = errMismatch
+	}
+	return err
+}
+
+// mergeDisc reads files into a new Merger. The Merger is returned even on
+// failure and must be closed.
+func mergeDisc(files []*merge.FileInfo) (*merge.Merger, int) {
+	m := merge.New(merge.Options{
+		CueSheet:  *flagCueSheet,
+		CueTags:   *flagCueTags,
+		RoundTime: *flagRound,
+		DryRun:    *flagDryRun,
+		Fast:      *flagFast,
+		SeekTable: seekTable,
+		Pictures:  pictureModes[*flagPictures],
+		Padding:   padding,
+		TagsFirst: *flagTagsFirst,
+	})
+
+	// read files
+	var inputs []merge.Input
+	for _, info := range files {
+		if !*flagSilent {
+			fmt.Printf("Processing: %s\n", info.Path)
 		}
-		if frame.BlockSize < blockSizeMin {
-			blockSizeMin = frame.BlockSize
+		pregap, err := filepath.Match(*flagPregap, filepath.Base(info.Path))
+		if err != nil {
+			fmt.Println(err)
+			return m, 1
 		}
-		if frame.BlockSize > blockSizeMax {
-			blockSizeMax = frame.BlockSize
+		inputs = append(inputs, merge.Input{Path: info.Path, Pregap: pregap})
+	}
+	err := m.AddFiles(inputs)
+	if err != nil {
+		fmt.Println(err)
+		return m, exitCode(err, 3)
+	}
+
+	// external front cover
+	if *flagPictures == "file" && len(files) > 0 {
+		if path := findCover(filepath.Dir(files[0].Path)); path != "" {
+			pic, err := merge.ReadPictureFile(path)
+			if err != nil {
+				fmt.Println(err)
+				return m, 3
+			}
+			m.SetFrontCover(pic)
 		}
-		// next iteration
-		start = next
-		frames++
-		samples += uint64(frame.BlockSize)
 	}
 
-	// update totals
-	totalSamples += samples
-	totalFrames += frames
+	if *flagCueSheet && len(m.Tracks) > merge.MaxCueSheetTracks && !*flagSilent {
+		fmt.Printf("Warning: %d tracks do not fit into CUESHEET block (at most %d), not embedding it\n", len(m.Tracks), merge.MaxCueSheetTracks)
+	}
 
-	return nil
+	// check alignment to CD frames
+	for _, v := range m.Misaligned() {
+		if *flagExact {
+			fmt.Printf("Track %02d INDEX %02d at sample %d does not start on CD frame\n", v.Track, v.Index, v.Sample)
+		} else if !*flagSilent {
+			fmt.Printf("Warning: track %02d INDEX %02d at sample %d does not start on CD frame, using %s\n", v.Track, v.Index, v.Sample, v.Time)
+		}
+	}
+	if *flagExact && len(m.Misaligned()) > 0 {
+		return m, 6
+	}
+	return m, 0
 }
 
-func getUtf8Size(n uint64) (s int64) {
-	if n <= 1<<7-1 {
-		s = 1
-	} else if n <= 1<<11-1 {
-		s = 2
-	} else if n <= 1<<16-1 {
-		s = 3
-	} else if n <= 1<<21-1 {
-		s = 4
-	} else if n <= 1<<26-1 {
-		s = 5
-	} else if n <= 1<<31-1 {
-		s = 6
-	} else {
-		s = 7
-	}
-	return
+// pictureModes are the modes of --pictures.
+var pictureModes = map[string]merge.PictureMode{
+	"front":   merge.PictureFront,
+	"first":   merge.PictureFirst,
+	"all":     merge.PictureAll,
+	"largest": merge.PictureLargest,
+	"file":    merge.PictureFront,
 }
 
-func encodeUtf8(n uint64) []byte {
-	b := make([]byte, 7)
-	if n <= 1<<7-1 {
-		b[0] = byte(n & 0x7F)
-		return b[:1]
-
-	} else if n <= 1<<11-1 {
-		b[0] = byte(n>>6&0x1F | 0xC0)
-		b[1] = byte(n&0x3F | 0x80)
-		return b[:2]
-
-	} else if n <= 1<<16-1 {
-		b[0] = byte(n>>12&0x0F | 0xE0)
-		b[1] = byte(n>>6&0x3F | 0x80)
-		b[2] = byte(n&0x3F | 0x80)
-		return b[:3]
-
-	} else if n <= 1<<21-1 {
-		b[0] = byte(n>>18&0x07 | 0xF0)
-		b[1] = byte(n>>12&0x3F | 0x80)
-		b[2] = byte(n>>6&0x3F | 0x80)
-		b[3] = byte(n&0x3F | 0x80)
-		return b[:4]
-
-	} else if n <= 1<<26-1 {
-		b[0] = byte(n>>24&0x03 | 0xF8)
-		b[1] = byte(n>>18&0x3F | 0x80)
-		b[2] = byte(n>>12&0x3F | 0x80)
-		b[3] = byte(n>>6&0x3F | 0x80)
-		b[4] = byte(n&0x3F | 0x80)
-		return b[:5]
-
-	} else if n <= 1<<31-1 {
-		b[0] = byte(n>>30&0x01 | 0xFC)
-		b[1] = byte(n>>24&0x3F | 0x80)
-		b[2] = byte(n>>18&0x3F | 0x80)
-		b[3] = byte(n>>12&0x3F | 0x80)
-		b[4] = byte(n>>6&0x3F | 0x80)
-		b[5] = byte(n&0x3F | 0x80)
-		return b[:6]
-
-	} else {
-		b[0] = byte(0xFE)
-		b[1] = byte(n>>30&0x3F | 0x80)
-		b[2] = byte(n>>24&0x3F | 0x80)
-		b[3] = byte(n>>18&0x3F | 0x80)
-		b[4] = byte(n>>12&0x3F | 0x80)
-		b[5] = byte(n>>6&0x3F | 0x80)
-		b[6] = byte(n&0x3F | 0x80)
-		return b[:7]
+// coverNames are the names of external cover files in order of preference.
+var coverNames = []string{"cover.jpg", "cover.jpeg", "cover.png", "folder.jpg", "folder.jpeg", "folder.png", "front.jpg", "front.png"}
+
+// findCover returns the path of the external cover file in dir, or "".
+// Names are matched case-insensitively.
+func findCover(dir string) string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, name := range coverNames {
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.EqualFold(entry.Name(), name) {
+				return filepath.Join(dir, entry.Name())
+			}
+		}
+	}
+	return ""
+}
 
+// writeResult writes the FLAC file, the optional CUE-sheet and chapters of m
+// to out.
+func writeResult(out *outputs, m *merge.Merger, filename string, cue bool) int {
+	if !*flagSilent {
+		switch {
+		case cue && *flagChapters:
+			fmt.Printf("Writing to \"%s.[flac|cue|json]\"\n", filename)
+		case cue:
+			fmt.Printf("Writing to \"%s.[flac|cue]\"\n", filename)
+		case *flagChapters:
+			fmt.Printf("Writing to \"%s.[flac|json]\"\n", filename)
+		default:
+			fmt.Printf("Writing to \"%s.flac\"\n", filename)
+		}
 	}
 
+	// write flac-file
+	ro, err := out.create(fmt.Sprintf("%s.flac", filename))
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	_, err = m.WriteTo(ro)
+	if err != nil {
+		fmt.Println(err)
+		return exitCode(err, 2)
+	}
+
+	// write cue-file
+	if cue {
+		rcue, err := out.create(fmt.Sprintf("%s.cue", filename))
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+
+		err = m.WriteCue(rcue, m.File)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+	}
+
+	// write chapters
+	if *flagChapters {
+		rjson, err := out.create(fmt.Sprintf("%s.json", filename))
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+
+		err = m.WriteChapters(rjson, m.File)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+	}
+
+	return 0
 }
 
-func encUint32(b []byte, n uint32) {
-	b[0] = byte(n >> 24 & 255)
-	b[1] = byte(n >> 16 & 255)
-	b[2] = byte(n >> 8 & 255)
-	b[3] = byte(n & 255)
-	return
+// writePictures writes the data of pictures to files named base with the
+// extension of their MIME type; further pictures get numbered names.
+func writePictures(out *outputs, pictures []*meta.Picture, base string) int {
+	for i, pic := range pictures {
+		name := base
+		if i > 0 {
+			name = fmt.Sprintf("%s%d", base, i+1)
+		}
+		name += merge.PictureExt(pic)
+		if !*flagSilent {
+			fmt.Printf("Writing to \"%s\"\n", name)
+		}
+		f, err := out.create(name)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		_, err = f.Write(pic.Data)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+	}
+	return 0
 }
 
-func samplesToTime(n uint64) string {
-	t := n * 75 / uint64(sampleRate)
-	m := t / (60 * 75)
-	s := (t - m*60*75) / 75
-	f := t % 75
-	return fmt.Sprintf("%02d:%02d:%02d", m, s, f)
+// printPlan prints the planned result of merging.
+func printPlan(m *merge.Merger, filename string) {
+	fmt.Printf("Output: \"%s.[flac|cue]\"\n", filename)
+	fmt.Printf("Format: %d Hz, %d bit, %d channels\n", m.SampleRate, m.BitsPerSample, m.NChannels)
+	fmt.Printf("PERFORMER \"%s\"\n", m.Performer())
+	fmt.Printf("TITLE \"%s\"\n", m.Album)
+	for i, v := range m.Tracks {
+		if v.Pregap > 0 {
+			fmt.Printf("  %02d. %s %s (INDEX 00 %s)\n", i+1, m.CueTime(v.Offset), v.Title, m.CueTime(v.Offset-v.Pregap))
+		} else {
+			fmt.Printf("  %02d. %s %s\n", i+1, m.CueTime(v.Offset), v.Title)
+		}
+	}
+	fmt.Printf("Duration: %s (%d samples)\n", m.CueTime(m.TotalSamples()), m.TotalSamples())
+	fmt.Printf("Estimated size: %d bytes\n", m.Size())
 }
 
-func quoteCue(s string) string {
-	return strings.Replace(s, "\"", "'", -1)
+// writeFlac writes the merged stream of m to a new FLAC file. With --delete
+// the file is checked against the inputs of m before it is moved into place.
+func writeFlac(path string, m *merge.Merger) error {
+	var out outputs
+	defer out.cleanup()
+	ro, err := out.create(path)
+	if err != nil {
+		return err
+	}
+	_, err = m.WriteTo(ro)
+	if err != nil {
+		return err
+	}
+	if *flagDelete {
+		err = checkResult(m, path, out.tempName(path))
+		if err != nil {
+			return err
+		}
+	}
+	return out.commit()
+}
+
+// deleteInputs removes the input files if --delete is given.
+func deleteInputs(paths []string) int {
+	if !*flagDelete {
+		return 0
+	}
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil {
+			fmt.Println(err)
+			return 3
+		}
+	}
+	return 0
 }
 
 func quoteFilename(s string) string {
@@ -599,5 +765,5 @@ func quoteFilename(s string) string {
 	if err != nil {
 		panic(err)
 	}
-	return reg.ReplaceAllString(quoteCue(s), "")
+	return reg.ReplaceAllString(strings.Replace(s, "\"", "'", -1), "")
 }
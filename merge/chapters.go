@@ -0,0 +1,65 @@
+package merge
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// chapters is the JSON document written by WriteChapters.
+type chapters struct {
+	File         string    `json:"file"`
+	SampleRate   uint32    `json:"sample_rate"`
+	TotalSamples uint64    `json:"total_samples"`
+	Duration     float64   `json:"duration"`
+	Tracks       []chapter `json:"tracks"`
+}
+
+type chapter struct {
+	Number    int     `json:"number"`
+	Title     string  `json:"title"`
+	Performer string  `json:"performer,omitempty"`
+	Sample    uint64  `json:"start_sample"`
+	Start     float64 `json:"start"`
+	// pregap (INDEX 00)
+	PregapSample *uint64  `json:"pregap_sample,omitempty"`
+	PregapStart  *float64 `json:"pregap_start,omitempty"`
+}
+
+// WriteChapters writes sample-accurate track positions of the merged stream
+// stored in the given file as JSON. Unlike CUE-sheet times they are not
+// rounded to CD frames.
+func (m *Merger) WriteChapters(w io.Writer, file string) error {
+	if m.pregap > 0 {
+		return errPregap
+	}
+	doc := chapters{
+		File:         file,
+		SampleRate:   m.SampleRate,
+		TotalSamples: m.totalSamples,
+		Duration:     m.seconds(m.totalSamples),
+		Tracks:       make([]chapter, 0, len(m.Tracks)),
+	}
+	for i, v := range m.Tracks {
+		c := chapter{
+			Number:    i + 1,
+			Title:     v.Title,
+			Performer: v.Performer,
+			Sample:    v.Offset,
+			Start:     m.seconds(v.Offset),
+		}
+		if v.Pregap > 0 {
+			sample := v.Offset - v.Pregap
+			start := m.seconds(sample)
+			c.PregapSample, c.PregapStart = &sample, &start
+		}
+		doc.Tracks = append(doc.Tracks, c)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return writeError(w, enc.Encode(doc))
+}
+
+func (m *Merger) seconds(n uint64) float64 {
+	return float64(n) / float64(m.SampleRate)
+}
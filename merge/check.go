@@ -0,0 +1,130 @@
+package merge
+
+import (
+	"bufio"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mewkiz/flac/frame"
+	"github.com/sdidyk/flac2one/flac"
+)
+
+// CheckResult compares an added stream with its part of the merged stream.
+type CheckResult struct {
+	// Path is the file of the added stream, empty for streams added by Add.
+	Path string
+	// Samples and MD5 are decoded from the merged stream; Expected ones are
+	// taken from STREAMINFO of the added stream. If STREAMINFO has no MD5
+	// sum, the added stream is decoded for it.
+	Samples, ExpectedSamples uint64
+	MD5, ExpectedMD5         [md5.Size]byte
+}
+
+// OK reports whether the number of samples and the MD5 sum match.
+func (res CheckResult) OK() bool {
+	return res.Samples == res.ExpectedSamples && res.MD5 == res.ExpectedMD5
+}
+
+// CheckFile decodes the merged stream written to the file at path and
+// compares every added stream with its part of it.
+func (m *Merger) CheckFile(path string) ([]CheckResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, &VerificationError{Path: path, Frame: -1, Err: err}
+	}
+	defer f.Close()
+	results, err := m.Check(f)
+	if e, ok := err.(*VerificationError); ok {
+		e.Path = path
+	}
+	return results, err
+}
+
+// Check decodes the merged stream of r and compares every added stream with
+// its part of it. Decoding errors are VerificationError; errors of decoding
+// an added stream without MD5 sum are InputParseError.
+func (m *Merger) Check(r io.Reader) ([]CheckResult, error) {
+	if len(m.sources) == 0 {
+		return nil, fmt.Errorf("no added streams")
+	}
+	stream, err := flac.Parse(r)
+	if err != nil {
+		return nil, &VerificationError{Frame: -1, Err: err}
+	}
+
+	// expected results
+	results := make([]CheckResult, len(m.sources))
+	var unknown [md5.Size]byte
+	for i, src := range m.sources {
+		results[i].Path = src.path
+		results[i].ExpectedSamples = src.samples
+		if src.info != nil {
+			results[i].ExpectedMD5 = src.info.MD5sum
+			if src.info.NSamples != 0 {
+				results[i].ExpectedSamples = src.info.NSamples
+			}
+		}
+		if results[i].ExpectedMD5 == unknown {
+			results[i].ExpectedMD5, err = sourceMD5(src)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// decode
+	md5sum := md5.New()
+	pos := uint64(0)
+	i := 0
+	for n := 0; ; n++ {
+		frame, err := stream.ParseNext()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, &VerificationError{Frame: n, Err: err}
+		}
+
+		// switch to next source
+		for i+1 < len(m.sources) && pos >= m.sources[i].start+m.sources[i].samples {
+			copy(results[i].MD5[:], md5sum.Sum(nil))
+			md5sum.Reset()
+			i++
+		}
+		frame.Hash(md5sum)
+		results[i].Samples += uint64(frame.BlockSize)
+		pos += uint64(frame.BlockSize)
+	}
+	copy(results[i].MD5[:], md5sum.Sum(nil))
+	return results, nil
+}
+
+// sourceMD5 decodes the frames of src and returns the MD5 sum of their
+// samples.
+func sourceMD5(src *source) (sum [md5.Size]byte, err error) {
+	md5sum := md5.New()
+	if len(src.frames) > 0 {
+		ra := src.ra
+		if src.path != "" {
+			f, err := os.Open(src.path)
+			if err != nil {
+				return sum, &InputParseError{src.path, -1, err}
+			}
+			defer f.Close()
+			ra = f
+		}
+		first, last := src.frames[0], src.frames[len(src.frames)-1]
+		r := bufio.NewReader(io.NewSectionReader(ra, first.offset, last.offset+int64(last.size)-first.offset))
+		for i := range src.frames {
+			fr, err := frame.Parse(r)
+			if err != nil {
+				return sum, &InputParseError{src.path, i, err}
+			}
+			fr.Hash(md5sum)
+		}
+	}
+	copy(sum[:], md5sum.Sum(nil))
+	return sum, nil
+}
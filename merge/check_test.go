@@ -0,0 +1,69 @@
+package merge
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	a := newTestStream("One", 10000, 4096, 0)
+	b := newTestStream("Two", 5000, 1152, 100)
+	m := mergeTestStreams(t, Options{}, a, b)
+	var out bytes.Buffer
+	if _, err := m.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	results, err := m.Check(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for i, res := range results {
+		if !res.OK() {
+			t.Errorf("stream %d: %+v", i, res)
+		}
+	}
+	if results[1].Samples != 5000 {
+		t.Errorf("stream 1: got %d samples, want 5000", results[1].Samples)
+	}
+
+	// wrong MD5 sum in STREAMINFO of source
+	a.data[4+4+18] ^= 1
+	m = mergeTestStreams(t, Options{}, a, b)
+	out.Reset()
+	if _, err := m.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	results, err = m.Check(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].OK() || !results[1].OK() {
+		t.Errorf("expected mismatch of stream 0 only: %+v", results)
+	}
+
+	// unknown MD5 sum in STREAMINFO of source is decoded
+	copy(a.data[4+4+18:], make([]byte, 16))
+	m = mergeTestStreams(t, Options{}, a, b)
+	results, err = m.Check(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !results[0].OK() || results[0].ExpectedMD5 != results[0].MD5 {
+		t.Errorf("expected decoded MD5 sum of stream 0: %+v", results[0])
+	}
+	other := newTestStream("One", 10000, 4096, 1)
+	out.Reset()
+	if _, err := mergeTestStreams(t, Options{}, other, b).WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	results, err = m.Check(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].OK() || !results[1].OK() {
+		t.Errorf("expected mismatch of stream 0 only: %+v", results)
+	}
+}
@@ -0,0 +1,477 @@
+package merge
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/mewkiz/flac/meta"
+)
+
+// CueSheet contains the parts of a CUE-sheet used by flac2one.
+type CueSheet struct {
+	Performer  string
+	Songwriter string
+	Title      string
+	Date       string
+	Genre      string
+	Composer   string
+	Comment    string
+	Disc       int
+	TotalDiscs int
+	File       string
+	Tracks     []CueTrack
+}
+
+// CueTrack is a TRACK entry of a CUE-sheet.
+type CueTrack struct {
+	Num        int
+	Title      string
+	Performer  string
+	Songwriter string
+	ISRC       string
+	Composer   string
+	Comment    string
+	// INDEX 01 position in CD frames (1/75 sec)
+	Index uint64
+}
+
+// ParseCue reads a CUE-sheet with a single FILE entry.
+func ParseCue(r io.Reader) (cue *CueSheet, err error) {
+	cue = &CueSheet{}
+	var track *CueTrack
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		fields := splitCueLine(strings.TrimPrefix(s.Text(), "\uFEFF"))
+		if len(fields) == 0 {
+			continue
+		}
+		arg := func(i int) string {
+			if i < len(fields) {
+				return fields[i]
+			}
+			return ""
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "REM":
+			switch strings.ToUpper(arg(1)) {
+			case "DATE":
+				cue.Date = arg(2)
+			case "GENRE":
+				cue.Genre = arg(2)
+			case "DISCNUMBER":
+				cue.Disc, _ = strconv.Atoi(arg(2))
+			case "TOTALDISCS":
+				cue.TotalDiscs, _ = strconv.Atoi(arg(2))
+			case "COMPOSER":
+				if track != nil {
+					track.Composer = arg(2)
+				} else {
+					cue.Composer = arg(2)
+				}
+			case "COMMENT":
+				if track != nil {
+					track.Comment = arg(2)
+				} else {
+					cue.Comment = arg(2)
+				}
+			}
+		case "PERFORMER":
+			if track != nil {
+				track.Performer = arg(1)
+			} else {
+				cue.Performer = arg(1)
+			}
+		case "SONGWRITER":
+			if track != nil {
+				track.Songwriter = arg(1)
+			} else {
+				cue.Songwriter = arg(1)
+			}
+		case "ISRC":
+			if track != nil {
+				track.ISRC = arg(1)
+			}
+		case "TITLE":
+			if track != nil {
+				track.Title = arg(1)
+			} else {
+				cue.Title = arg(1)
+			}
+		case "FILE":
+			if cue.File != "" {
+				return nil, fmt.Errorf("line %d: multiple FILE entries are not supported", line)
+			}
+			cue.File = arg(1)
+		case "TRACK":
+			num, err := strconv.Atoi(arg(1))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid track number %q", line, arg(1))
+			}
+			cue.Tracks = append(cue.Tracks, CueTrack{Num: num})
+			track = &cue.Tracks[len(cue.Tracks)-1]
+		case "INDEX":
+			if track == nil {
+				return nil, fmt.Errorf("line %d: INDEX outside of TRACK", line)
+			}
+			if arg(1) != "01" && arg(1) != "1" {
+				continue
+			}
+			track.Index, err = timeToFrames(arg(2))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if cue.File == "" {
+		return nil, fmt.Errorf("no FILE entry")
+	}
+	if len(cue.Tracks) == 0 {
+		return nil, fmt.Errorf("no TRACK entries")
+	}
+	for i := 1; i < len(cue.Tracks); i++ {
+		if cue.Tracks[i].Index <= cue.Tracks[i-1].Index {
+			return nil, fmt.Errorf("track %02d does not start after track %02d", cue.Tracks[i].Num, cue.Tracks[i-1].Num)
+		}
+	}
+
+	return cue, nil
+}
+
+// Start returns the number of the first sample of the track.
+func (track CueTrack) Start(sampleRate uint32) uint64 {
+	return track.Index * uint64(sampleRate) / 75
+}
+
+// WriteCue writes a CUE-sheet for the merged stream stored in the given file.
+func (m *Merger) WriteCue(w io.Writer, file string) error {
+	if m.pregap > 0 {
+		return errPregap
+	}
+	_, err := io.WriteString(w, m.cueText(file))
+	return writeError(w, err)
+}
+
+// WriteMultiCue writes one CUE-sheet for the merged streams of discs stored
+// in files. Album tags are taken from the first disc; track numbers restart
+// at every disc.
+func WriteMultiCue(w io.Writer, discs []*Merger, files []string) error {
+	if len(discs) == 0 || len(discs) != len(files) {
+		return fmt.Errorf("number of discs and files mismatch")
+	}
+	album := *discs[0]
+	album.Tracks = nil
+	album.Disc = 0
+	if album.TotalDiscs < len(discs) {
+		album.TotalDiscs = len(discs)
+	}
+	for _, m := range discs {
+		if m.pregap > 0 {
+			return errPregap
+		}
+		album.Tracks = append(album.Tracks, m.Tracks...)
+	}
+
+	var buf bytes.Buffer
+	performer := album.Performer()
+	common := album.commonTrack()
+	album.cueHeader(&buf, performer, common)
+	for i, m := range discs {
+		disc := m.Disc
+		if disc == 0 {
+			disc = i + 1
+		}
+		fmt.Fprintf(&buf, "REM DISCNUMBER %d\n", disc)
+		m.cueFile(&buf, files[i], performer, common)
+	}
+	_, err := w.Write(buf.Bytes())
+	return writeError(w, err)
+}
+
+// cueText generates the CUE-sheet. Track tags which are identical in all
+// tracks are written once at album level.
+func (m *Merger) cueText(file string) string {
+	var buf bytes.Buffer
+	performer := m.Performer()
+	common := m.commonTrack()
+	m.cueHeader(&buf, performer, common)
+	if m.Disc > 0 {
+		fmt.Fprintf(&buf, "REM DISCNUMBER %d\n", m.Disc)
+	}
+	m.cueFile(&buf, file, performer, common)
+	return buf.String()
+}
+
+// cueHeader writes album entries of the CUE-sheet.
+func (m *Merger) cueHeader(buf *bytes.Buffer, performer string, common Track) {
+	if m.Date != "" {
+		fmt.Fprintf(buf, "REM DATE %s\n", m.Date)
+	}
+	if m.Genre != "" {
+		fmt.Fprintf(buf, "REM GENRE %s\n", m.Genre)
+	}
+	if common.Composer != "" {
+		fmt.Fprintf(buf, "REM COMPOSER \"%s\"\n", quoteCue(common.Composer))
+	}
+	if common.Comment != "" {
+		fmt.Fprintf(buf, "REM COMMENT \"%s\"\n", quoteCue(common.Comment))
+	}
+	fmt.Fprintf(buf, "PERFORMER \"%s\"\n", quoteCue(performer))
+	if common.Songwriter != "" {
+		fmt.Fprintf(buf, "SONGWRITER \"%s\"\n", quoteCue(common.Songwriter))
+	}
+	fmt.Fprintf(buf, "TITLE \"%s\"\n", quoteCue(m.Album))
+	if m.TotalDiscs > 0 {
+		fmt.Fprintf(buf, "REM TOTALDISCS %d\n", m.TotalDiscs)
+	}
+}
+
+// cueFile writes the FILE entry and the tracks of the CUE-sheet.
+func (m *Merger) cueFile(buf *bytes.Buffer, file string, performer string, common Track) {
+	fmt.Fprintf(buf, "FILE \"%s\" WAVE\n", file)
+	for i, v := range m.Tracks {
+		fmt.Fprintf(buf, "  TRACK %02d AUDIO\n", i+1)
+		fmt.Fprintf(buf, "    TITLE \"%s\"\n", quoteCue(v.Title))
+		if v.Performer != "" && common.Performer != performer {
+			fmt.Fprintf(buf, "    PERFORMER \"%s\"\n", quoteCue(v.Performer))
+		}
+		if v.Songwriter != "" && common.Songwriter == "" {
+			fmt.Fprintf(buf, "    SONGWRITER \"%s\"\n", quoteCue(v.Songwriter))
+		}
+		if v.ISRC != "" {
+			fmt.Fprintf(buf, "    ISRC %s\n", v.ISRC)
+		}
+		if v.Composer != "" && common.Composer == "" {
+			fmt.Fprintf(buf, "    REM COMPOSER \"%s\"\n", quoteCue(v.Composer))
+		}
+		if v.Comment != "" && common.Comment == "" {
+			fmt.Fprintf(buf, "    REM COMMENT \"%s\"\n", quoteCue(v.Comment))
+		}
+		if v.Pregap > 0 {
+			fmt.Fprintf(buf, "    INDEX 00 %s\n", m.CueTime(v.Offset-v.Pregap))
+		}
+		fmt.Fprintf(buf, "    INDEX 01 %s\n", m.CueTime(v.Offset))
+	}
+}
+
+// Performer returns the album performer: ALBUMARTIST of the first stream if
+// present, else ARTIST if it is the same in all tracks, else ARTIST of the
+// first stream.
+func (m *Merger) Performer() string {
+	if m.AlbumArtist != "" {
+		return m.AlbumArtist
+	}
+	if performer := m.commonTrack().Performer; performer != "" {
+		return performer
+	}
+	return m.Artist
+}
+
+// commonTrack returns the track tags which are identical in all tracks.
+func (m *Merger) commonTrack() (common Track) {
+	if len(m.Tracks) == 0 {
+		return
+	}
+	common.Performer = m.Tracks[0].Performer
+	common.Songwriter = m.Tracks[0].Songwriter
+	common.Composer = m.Tracks[0].Composer
+	common.Comment = m.Tracks[0].Comment
+	for _, v := range m.Tracks[1:] {
+		if v.Performer != common.Performer {
+			common.Performer = ""
+		}
+		if v.Songwriter != common.Songwriter {
+			common.Songwriter = ""
+		}
+		if v.Composer != common.Composer {
+			common.Composer = ""
+		}
+		if v.Comment != common.Comment {
+			common.Comment = ""
+		}
+	}
+	return
+}
+
+// comment returns the VORBIS_COMMENT metadata block with album tags. With
+// CueTags it also holds the CUE-sheet and titles of the tracks.
+func (m *Merger) comment() *meta.VorbisComment {
+	vc := &meta.VorbisComment{Vendor: Vendor}
+	addTag := func(name, value string) {
+		if value != "" {
+			vc.Tags = append(vc.Tags, [2]string{name, value})
+		}
+	}
+	addTag("ALBUM", m.Album)
+	addTag("ARTIST", m.Artist)
+	addTag("ALBUMARTIST", m.AlbumArtist)
+	addTag("DATE", m.Date)
+	addTag("GENRE", m.Genre)
+	if m.Disc > 0 {
+		addTag("DISCNUMBER", strconv.Itoa(m.Disc))
+	}
+	if m.TotalDiscs > 0 {
+		addTag("TOTALDISCS", strconv.Itoa(m.TotalDiscs))
+	}
+	for _, tag := range m.Tags {
+		addTag(tag[0], tag[1])
+	}
+
+	if m.Options.CueTags {
+		addTag("CUESHEET", m.cueText(m.File))
+		for i, v := range m.Tracks {
+			addTag(fmt.Sprintf("TRACK%02d_TITLE", i+1), v.Title)
+		}
+	}
+	return vc
+}
+
+// MaxCueSheetTracks is the largest number of tracks of a CUESHEET block:
+// track numbers are 1-254, 255 is the lead-out.
+const MaxCueSheetTracks = 254
+
+// maxCompactDiscTracks is the largest number of tracks of a CD-DA.
+const maxCompactDiscTracks = 99
+
+// cueBlock returns the CUESHEET metadata block with the track positions. It
+// is marked as CD-DA only if the stream and all tracks conform to it.
+func (m *Merger) cueBlock() *meta.CueSheet {
+	cs := &meta.CueSheet{
+		IsCompactDisc: m.SampleRate == 44100 && m.NChannels == 2 && m.BitsPerSample == 16 &&
+			m.totalSamples%588 == 0 && len(m.Tracks) <= maxCompactDiscTracks,
+	}
+	for _, v := range m.Tracks {
+		if v.Offset%588 != 0 || v.Pregap%588 != 0 {
+			cs.IsCompactDisc = false
+		}
+	}
+	if cs.IsCompactDisc {
+		cs.NLeadInSamples = 88200
+	}
+
+	for i, v := range m.Tracks {
+		indicies := []meta.CueSheetTrackIndex{{Offset: 0, Num: 1}}
+		if v.Pregap > 0 {
+			indicies = []meta.CueSheetTrackIndex{{Offset: 0, Num: 0}, {Offset: v.Pregap, Num: 1}}
+		}
+		cs.Tracks = append(
+			cs.Tracks,
+			meta.CueSheetTrack{
+				Offset:   v.Offset - v.Pregap,
+				Num:      uint8(i + 1),
+				ISRC:     v.ISRC,
+				IsAudio:  true,
+				Indicies: indicies,
+			},
+		)
+	}
+
+	// lead-out track
+	leadOut := meta.CueSheetTrack{Offset: m.totalSamples, Num: 255, IsAudio: true}
+	if cs.IsCompactDisc {
+		leadOut.Num = 170
+	}
+	cs.Tracks = append(cs.Tracks, leadOut)
+	return cs
+}
+
+// splitCueLine splits a CUE-sheet line into fields. Double-quoted fields may
+// contain spaces.
+func splitCueLine(s string) (fields []string) {
+	s = strings.TrimSpace(s)
+	for s != "" {
+		var field string
+		if s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end == -1 {
+				field, s = s[1:], ""
+			} else {
+				field, s = s[1:end+1], s[end+2:]
+			}
+		} else {
+			end := strings.IndexAny(s, " \t")
+			if end == -1 {
+				field, s = s, ""
+			} else {
+				field, s = s[:end], s[end:]
+			}
+		}
+		fields = append(fields, field)
+		s = strings.TrimLeft(s, " \t")
+	}
+	return
+}
+
+// timeToFrames converts a "mm:ss:ff" CUE-sheet time to CD frames.
+func timeToFrames(s string) (uint64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	var v [3]uint64
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		v[i] = n
+	}
+	if v[1] >= 60 || v[2] >= 75 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return (v[0]*60+v[1])*75 + v[2], nil
+}
+
+// Misalignment is a track index which does not start on a CD frame
+// (1/75 sec), so its CUE-sheet time is not exact.
+type Misalignment struct {
+	// Track number, starting from 1.
+	Track int
+	// Index number, 0 for pregap or 1 for track start.
+	Index int
+	// Sample is the number of the first sample of the index.
+	Sample uint64
+	// Time is the CUE-sheet time of the index.
+	Time string
+}
+
+// Misaligned returns the track indexes which do not start on a CD frame.
+func (m *Merger) Misaligned() (list []Misalignment) {
+	for i, v := range m.Tracks {
+		if v.Pregap > 0 && !m.isAligned(v.Offset-v.Pregap) {
+			list = append(list, Misalignment{i + 1, 0, v.Offset - v.Pregap, m.CueTime(v.Offset - v.Pregap)})
+		}
+		if !m.isAligned(v.Offset) {
+			list = append(list, Misalignment{i + 1, 1, v.Offset, m.CueTime(v.Offset)})
+		}
+	}
+	return list
+}
+
+func (m *Merger) isAligned(n uint64) bool {
+	return n*75%uint64(m.SampleRate) == 0
+}
+
+// CueTime converts a sample number to "mm:ss:ff" CUE-sheet time.
+func (m *Merger) CueTime(n uint64) string {
+	t := n * 75 / uint64(m.SampleRate)
+	if m.Options.RoundTime && n*75%uint64(m.SampleRate) >= (uint64(m.SampleRate)+1)/2 {
+		t++
+	}
+	mm := t / (60 * 75)
+	ss := (t - mm*60*75) / 75
+	ff := t % 75
+	return fmt.Sprintf("%02d:%02d:%02d", mm, ss, ff)
+}
+
+func quoteCue(s string) string {
+	return strings.Replace(s, "\"", "'", -1)
+}
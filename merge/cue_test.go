@@ -0,0 +1,197 @@
+package merge
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseCue(t *testing.T) {
+	const in = "\uFEFFREM GENRE \"Industrial Rock\"\r\n" +
+		"REM DATE 1989\r\n" +
+		"PERFORMER \"Nine Inch Nails\"\r\n" +
+		"TITLE \"Pretty Hate Machine\"\r\n" +
+		"FILE \"Nine Inch Nails - Pretty Hate Machine.flac\" WAVE\r\n" +
+		"  TRACK 01 AUDIO\r\n" +
+		"    TITLE \"Head Like a Hole\"\r\n" +
+		"    INDEX 01 00:00:00\r\n" +
+		"  TRACK 02 AUDIO\r\n" +
+		"    TITLE \"Terrible Lie\"\r\n" +
+		"    PERFORMER Trent\r\n" +
+		"    INDEX 00 04:58:70\r\n" +
+		"    INDEX 01 04:59:05\r\n"
+	cue, err := ParseCue(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cue.Genre != "Industrial Rock" || cue.Date != "1989" || cue.Performer != "Nine Inch Nails" ||
+		cue.Title != "Pretty Hate Machine" || cue.File != "Nine Inch Nails - Pretty Hate Machine.flac" {
+		t.Errorf("unexpected album fields %+v", cue)
+	}
+	want := []CueTrack{
+		{Num: 1, Title: "Head Like a Hole"},
+		{Num: 2, Title: "Terrible Lie", Performer: "Trent", Index: (4*60+59)*75 + 5},
+	}
+	if len(cue.Tracks) != len(want) {
+		t.Fatalf("tracks; expected %d, got %d", len(want), len(cue.Tracks))
+	}
+	for i := range want {
+		if cue.Tracks[i] != want[i] {
+			t.Errorf("track %d; expected %+v, got %+v", i+1, want[i], cue.Tracks[i])
+		}
+	}
+	if got := cue.Tracks[1].Start(44100); got != 13188840 {
+		t.Errorf("track start; expected 13188840, got %d", got)
+	}
+}
+
+func TestParseCueErrors(t *testing.T) {
+	for _, in := range []string{
+		"TRACK 01 AUDIO\nINDEX 01 00:00:00\n",
+		"FILE \"a.flac\" WAVE\n",
+		"FILE \"a.flac\" WAVE\nTRACK 01 AUDIO\nINDEX 01 00:60:00\n",
+		"FILE \"a.flac\" WAVE\nTRACK 01 AUDIO\nINDEX 01 00:10:00\nTRACK 02 AUDIO\nINDEX 01 00:05:00\n",
+		"FILE \"a.flac\" WAVE\nFILE \"b.flac\" WAVE\nTRACK 01 AUDIO\nINDEX 01 00:00:00\n",
+	} {
+		if _, err := ParseCue(strings.NewReader(in)); err == nil {
+			t.Errorf("expected error for %q", in)
+		}
+	}
+}
+
+func TestWriteCue(t *testing.T) {
+	m := New(Options{})
+	m.SampleRate = 44100
+	m.Album = "Album"
+	m.Artist = "A"
+	m.AlbumArtist = "Various Artists"
+	m.Tracks = []Track{
+		{Title: "One", Performer: "A", Composer: "C", ISRC: "USABC0000001"},
+		{Title: "Two", Performer: "B", Composer: "C", Comment: "live", Offset: 44100},
+	}
+	want := `REM COMPOSER "C"
+PERFORMER "Various Artists"
+TITLE "Album"
+FILE "a.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "One"
+    PERFORMER "A"
+    ISRC USABC0000001
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Two"
+    PERFORMER "B"
+    REM COMMENT "live"
+    INDEX 01 00:01:00
+`
+	var buf strings.Builder
+	if err := m.WriteCue(&buf, "a.flac"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, buf.String())
+	}
+
+	// identical performers are hoisted to album level
+	m.AlbumArtist = ""
+	m.Tracks[1].Performer = "A"
+	buf.Reset()
+	m.WriteCue(&buf, "a.flac")
+	if got := buf.String(); !strings.Contains(got, "PERFORMER \"A\"\nTITLE") || strings.Contains(got, "    PERFORMER") {
+		t.Errorf("performer not hoisted:\n%s", got)
+	}
+}
+
+func TestWriteMultiCue(t *testing.T) {
+	var discs []*Merger
+	for i, title := range []string{"One", "Two"} {
+		m := New(Options{})
+		m.SampleRate = 44100
+		m.Album = "Album"
+		m.Artist = "A"
+		m.Disc = i + 1
+		m.Tracks = []Track{{Title: title, Performer: "A"}, {Title: title + "+", Performer: "A", Offset: 44100}}
+		discs = append(discs, m)
+	}
+	want := `PERFORMER "A"
+TITLE "Album"
+REM TOTALDISCS 2
+REM DISCNUMBER 1
+FILE "a1.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "One"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "One+"
+    INDEX 01 00:01:00
+REM DISCNUMBER 2
+FILE "a2.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "Two"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Two+"
+    INDEX 01 00:01:00
+`
+	var buf strings.Builder
+	if err := WriteMultiCue(&buf, discs, []string{"a1.flac", "a2.flac"}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, buf.String())
+	}
+}
+
+func TestMisaligned(t *testing.T) {
+	m := New(Options{})
+	m.SampleRate = 44100
+	m.Tracks = []Track{
+		{Offset: 0},
+		{Offset: 588*100 + 300},
+		{Offset: 588 * 200, Pregap: 10},
+	}
+	got := m.Misaligned()
+	want := []Misalignment{
+		{Track: 2, Index: 1, Sample: 588*100 + 300, Time: "00:01:25"},
+		{Track: 3, Index: 0, Sample: 588*200 - 10, Time: "00:02:49"},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	m.Options.RoundTime = true
+	if got := m.Misaligned(); got[0].Time != "00:01:26" || got[1].Time != "00:02:50" {
+		t.Errorf("rounded times; got %v", got)
+	}
+}
+
+func TestCueBlockTracks(t *testing.T) {
+	for _, tt := range []struct {
+		tracks      int
+		compactDisc bool
+		written     bool
+	}{
+		{99, true, true},
+		{100, false, true},
+		{254, false, true},
+		{255, false, false},
+	} {
+		m := New(Options{CueSheet: true})
+		m.SampleRate, m.NChannels, m.BitsPerSample = 44100, 2, 16
+		for i := 0; i < tt.tracks; i++ {
+			m.Tracks = append(m.Tracks, Track{Offset: uint64(i) * 588})
+		}
+		m.totalSamples = uint64(tt.tracks) * 588
+		if got := m.cueBlock().IsCompactDisc; got != tt.compactDisc {
+			t.Errorf("%d tracks: got CD-DA %v, want %v", tt.tracks, got, tt.compactDisc)
+		}
+
+		var buf bytes.Buffer
+		m.writeCueSheet(&buf)
+		if written := buf.Len() > 0; written != tt.written {
+			t.Errorf("%d tracks: got CUESHEET written %v, want %v", tt.tracks, written, tt.written)
+		} else if written && int(buf.Bytes()[4+395]) != tt.tracks+1 {
+			t.Errorf("%d tracks: got %d tracks in CUESHEET", tt.tracks, buf.Bytes()[4+395])
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package merge
+
+import "fmt"
+
+// InputParseError is an error in reading or parsing an added stream.
+type InputParseError struct {
+	// Path is the file of the stream, empty for streams added by Add.
+	Path string
+	// Frame is the index of the frame in the stream, or -1.
+	Frame int
+	Err   error
+}
+
+func (e *InputParseError) Error() string {
+	return prefix(e.Path, e.Frame) + e.Err.Error()
+}
+
+func (e *InputParseError) Unwrap() error {
+	return e.Err
+}
+
+// FormatMismatchError is returned if the format of an added stream differs
+// from the format of the merged stream.
+type FormatMismatchError struct {
+	Path string
+	// Field is "sample rate", "num of channels" or "bits per sample".
+	Field         string
+	Expected, Got uint32
+}
+
+func (e *FormatMismatchError) Error() string {
+	return fmt.Sprintf("%s%s mismatch; expected %v, got %v", prefix(e.Path, -1), e.Field, e.Expected, e.Got)
+}
+
+// OutputWriteError is an error in writing the merged stream, a CUE-sheet or
+// chapters.
+type OutputWriteError struct {
+	// Path is the name of the written file if known.
+	Path string
+	Err  error
+}
+
+func (e *OutputWriteError) Error() string {
+	return prefix(e.Path, -1) + "write error: " + e.Err.Error()
+}
+
+func (e *OutputWriteError) Unwrap() error {
+	return e.Err
+}
+
+// VerificationError is returned if a merged stream is found to be invalid.
+type VerificationError struct {
+	Path string
+	// Frame is the index of the invalid frame, or -1.
+	Frame int
+	Err   error
+}
+
+func (e *VerificationError) Error() string {
+	return prefix(e.Path, e.Frame) + e.Err.Error()
+}
+
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
+// prefix returns "path: frame N: " with empty parts omitted.
+func prefix(path string, frame int) (s string) {
+	if path != "" {
+		s = path + ": "
+	}
+	if frame >= 0 {
+		s += fmt.Sprintf("frame %d: ", frame)
+	}
+	return s
+}
+
+// inputError returns err of the added stream at path as a typed error.
+func inputError(path string, err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *InputParseError:
+		e.Path = path
+		return e
+	case *FormatMismatchError:
+		e.Path = path
+		return e
+	}
+	return &InputParseError{Path: path, Frame: -1, Err: err}
+}
+
+// writeError returns err of writing to w as an OutputWriteError.
+func writeError(w interface{}, err error) error {
+	if err == nil {
+		return nil
+	}
+	e := &OutputWriteError{Err: err}
+	if f, ok := w.(interface{ Name() string }); ok {
+		e.Path = f.Name()
+	}
+	return e
+}
@@ -0,0 +1,240 @@
+package merge
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/sdidyk/flac2one/flac"
+	"github.com/sdidyk/flac2one/hashutil/crc16"
+	"github.com/sdidyk/flac2one/hashutil/crc8"
+)
+
+// fastWindowSize is the size of the reads of scanFramesFast; tests lower it.
+var fastWindowSize int64 = 1 << 20
+
+// maxFrameHeaderSize is the size of the largest frame header.
+const maxFrameHeaderSize = 16
+
+// scanStreamFast finds the frames of stream parsed from r without decoding
+// them. It fails with errStopped once stop is closed.
+func scanStreamFast(stream *flac.Stream, r io.ReadSeeker, stop <-chan struct{}) ([]scannedFrame, error) {
+	start, err := stream.Pos()
+	if err != nil {
+		return nil, err
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return scanFramesFast(stream, start, end, stream.Info.NSamples, stop)
+}
+
+// scanFramesFast finds the frames in [start, end) of r without decoding
+// them. A frame ends where a valid frame header follows and its CRC-16
+// matches. If nSamples is not 0 it must be the number of samples found. Only
+// a window of the data around the current frame is kept in memory.
+func scanFramesFast(r io.ReaderAt, start, end int64, nSamples uint64, stop <-chan struct{}) ([]scannedFrame, error) {
+	w := &window{r: r, start: start, end: end}
+	var frames []scannedFrame
+	var samples uint64
+	for w.start < end {
+		select {
+		case <-stop:
+			return nil, errStopped
+		default:
+		}
+
+		if err := w.fill(maxFrameHeaderSize); err != nil {
+			return nil, err
+		}
+		num, blockSize, size, ok := parseFrameHeader(w.data)
+		if !ok {
+			return nil, &InputParseError{Frame: len(frames), Err: fmt.Errorf("invalid frame header at offset %d", w.start)}
+		}
+
+		// find next frame
+		next := -1
+		crc := crc16.Update(0, crc16.IBMTable, w.data[:size])
+		done := size
+		for p := size + 2; ; p++ {
+			// next sync code or end of data
+			for {
+				if err := w.fill(p + 1); err != nil {
+					return nil, err
+				}
+				if p >= len(w.data) {
+					break
+				}
+				if i := bytes.IndexByte(w.data[p:], 0xFF); i >= 0 {
+					p += i
+					break
+				}
+				p = len(w.data)
+			}
+			if p > len(w.data) {
+				break
+			}
+			crc = crc16.Update(crc, crc16.IBMTable, w.data[done:p-2])
+			done = p - 2
+			if crc != uint16(w.data[p-2])<<8|uint16(w.data[p-1]) {
+				continue
+			}
+			if p == len(w.data) {
+				next = p
+				break
+			}
+			if err := w.fill(p + maxFrameHeaderSize); err != nil {
+				return nil, err
+			}
+			if _, _, _, ok := parseFrameHeader(w.data[p:]); ok {
+				next = p
+				break
+			}
+		}
+		if next < 0 {
+			return nil, &InputParseError{Frame: len(frames), Err: fmt.Errorf("invalid frame at offset %d", w.start)}
+		}
+
+		frames = append(frames, scannedFrame{w.start, w.start + int64(next), num, blockSize, w.data[1]&1 != 0})
+		samples += uint64(blockSize)
+		w.skip(next)
+	}
+	if nSamples != 0 && samples != nSamples {
+		return nil, fmt.Errorf("number of samples mismatch; expected %v, got %v", nSamples, samples)
+	}
+	return frames, nil
+}
+
+// window is the data of r in [start, end) read so far.
+type window struct {
+	r          io.ReaderAt
+	start, end int64
+	data       []byte
+}
+
+// fill reads data until it holds n bytes or reaches end.
+func (w *window) fill(n int) error {
+	for len(w.data) < n {
+		off := w.start + int64(len(w.data))
+		size := w.end - off
+		if size <= 0 {
+			return nil
+		}
+		if size > fastWindowSize {
+			size = fastWindowSize
+		}
+		if int64(cap(w.data)-len(w.data)) < size {
+			data := make([]byte, len(w.data), int64(len(w.data))+fastWindowSize)
+			copy(data, w.data)
+			w.data = data
+		}
+		k := len(w.data)
+		w.data = w.data[:k+int(size)]
+		if n, err := w.r.ReadAt(w.data[k:], off); n < int(size) {
+			return err
+		}
+	}
+	return nil
+}
+
+// skip drops the first n bytes of data.
+func (w *window) skip(n int) {
+	w.data = w.data[n:]
+	w.start += int64(n)
+}
+
+// parseFrameHeader parses the frame header at the start of b. It returns
+// the coded number, the block size and the size of the header, or false if
+// b does not start with a valid header.
+func parseFrameHeader(b []byte) (num uint64, blockSize uint16, size int, ok bool) {
+	if len(b) < 6 || b[0] != 0xFF || b[1]&0xFE != 0xF8 {
+		return 0, 0, 0, false
+	}
+	blockSizeBits := b[2] >> 4
+	sampleRateBits := b[2] & 0x0F
+	if blockSizeBits == 0 || sampleRateBits == 0x0F {
+		return 0, 0, 0, false
+	}
+
+	// coded number
+	num, size, ok = decodeUtf8(b[4:])
+	if !ok {
+		return 0, 0, 0, false
+	}
+	size += 4
+
+	// additional bytes
+	extra := 0
+	switch blockSizeBits {
+	case 6:
+		extra = 1
+	case 7:
+		extra = 2
+	}
+	switch sampleRateBits {
+	case 12:
+		extra++
+	case 13, 14:
+		extra += 2
+	}
+	if len(b) < size+extra+1 {
+		return 0, 0, 0, false
+	}
+
+	switch {
+	case blockSizeBits == 1:
+		blockSize = 192
+	case blockSizeBits <= 5:
+		blockSize = 576 << (blockSizeBits - 2)
+	case blockSizeBits == 6:
+		blockSize = uint16(b[size]) + 1
+	case blockSizeBits == 7:
+		blockSize = uint16(b[size])<<8 | uint16(b[size+1]) + 1
+	default:
+		blockSize = 256 << (blockSizeBits - 8)
+	}
+	size += extra
+
+	// crc8
+	if crc8.ChecksumATM(b[:size]) != b[size] {
+		return 0, 0, 0, false
+	}
+	return num, blockSize, size + 1, true
+}
+
+// decodeUtf8 decodes a number coded by encodeUtf8. It returns the number
+// and its size.
+func decodeUtf8(b []byte) (n uint64, size int, ok bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	switch {
+	case b[0]&0x80 == 0:
+		return uint64(b[0]), 1, true
+	case b[0]&0xE0 == 0xC0:
+		n, size = uint64(b[0]&0x1F), 2
+	case b[0]&0xF0 == 0xE0:
+		n, size = uint64(b[0]&0x0F), 3
+	case b[0]&0xF8 == 0xF0:
+		n, size = uint64(b[0]&0x07), 4
+	case b[0]&0xFC == 0xF8:
+		n, size = uint64(b[0]&0x03), 5
+	case b[0]&0xFE == 0xFC:
+		n, size = uint64(b[0]&0x01), 6
+	case b[0] == 0xFE:
+		n, size = 0, 7
+	default:
+		return 0, 0, false
+	}
+	if len(b) < size {
+		return 0, 0, false
+	}
+	for _, c := range b[1:size] {
+		if c&0xC0 != 0x80 {
+			return 0, 0, false
+		}
+		n = n<<6 | uint64(c&0x3F)
+	}
+	return n, size, true
+}
@@ -0,0 +1,54 @@
+package merge
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecodeUtf8(t *testing.T) {
+	for _, n := range []uint64{0, 127, 128, 2047, 2048, 65535, 65536, 1<<21 - 1, 1 << 21, 1<<26 - 1, 1 << 26, 1<<31 - 1, 1 << 31, 1<<36 - 1} {
+		b := encodeUtf8(n)
+		got, size, ok := decodeUtf8(b)
+		if !ok || got != n || size != len(b) {
+			t.Errorf("decodeUtf8(%x) = %d, %d, %v; want %d, %d", b, got, size, ok, n, len(b))
+		}
+	}
+}
+
+func TestMergeFast(t *testing.T) {
+	a := newTestStream("One", 10000, 4096, 0)
+	b := newTestStream("Two", 5000, 1152, 100)
+	var want bytes.Buffer
+	if _, err := mergeTestStreams(t, Options{}, a, b).WriteTo(&want); err != nil {
+		t.Fatal(err)
+	}
+	// MD5 sum is unknown
+	copy(want.Bytes()[4+4+18:], make([]byte, 16))
+
+	// frames spanning several reads
+	defer func(size int64) { fastWindowSize = size }(fastWindowSize)
+	for _, size := range []int64{1 << 20, 1000} {
+		fastWindowSize = size
+		var got bytes.Buffer
+		if _, err := mergeTestStreams(t, Options{Fast: true}, a, b).WriteTo(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("window %d: fast result differs from decoded one", size)
+		}
+	}
+
+	// stopped scan
+	stop := make(chan struct{})
+	close(stop)
+	if _, err := scanFramesFast(bytes.NewReader(a.data), 0, int64(len(a.data)), 0, stop); err != errStopped {
+		t.Errorf("expected stopped scan, got %v", err)
+	}
+
+	// broken frame
+	b.data[len(b.data)-100] ^= 1
+	m := New(Options{Fast: true})
+	if err := m.Add(bytes.NewReader(b.data)); err == nil {
+		t.Error("expected error for broken frame")
+	}
+}
@@ -0,0 +1,171 @@
+package merge
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/sdidyk/flac2one/hashutil/crc16"
+	"github.com/sdidyk/flac2one/hashutil/crc8"
+)
+
+// rewriteFrame returns a copy of the raw frame with its coded number num
+// replaced by newNum, a sample number if variable is set or else a frame
+// number. CRC-8 and CRC-16 are recalculated.
+func rewriteFrame(raw []byte, num, newNum uint64, variable bool) ([]byte, error) {
+	crcHeader := crc8.NewATM()
+	crcFrame := crc16.NewIBM()
+
+	// new sample number
+	oldNumSize := int(getUtf8Size(num))
+	newSampleNumber := encodeUtf8(newNum)
+
+	if len(raw) < 4+oldNumSize+1+2 {
+		return nil, fmt.Errorf("frame is too short (%d bytes)", len(raw))
+	}
+	b := make([]byte, 0, len(raw)+len(newSampleNumber)-oldNumSize)
+
+	// (header)
+	b = append(b, raw[:4]...)
+	// blocking strategy
+	if variable {
+		b[1] |= 1
+	} else {
+		b[1] &^= 1
+	}
+
+	additionalBytes := 0
+	// blocksize bits == 011x
+	if b[2]&0xE0 == 0x60 {
+		additionalBytes++
+		if b[2]&0x10>>4 != 0 {
+			additionalBytes++
+		}
+	}
+	// sample rate bits == 11xx
+	if b[2]&0x0C == 0x0C {
+		additionalBytes++
+		if b[2]&0x03 != 0 {
+			additionalBytes++
+		}
+	}
+	if len(raw) < 4+oldNumSize+additionalBytes+1+2 {
+		return nil, fmt.Errorf("frame is too short (%d bytes)", len(raw))
+	}
+
+	// (new frame number)
+	b = append(b, newSampleNumber...)
+
+	// (additional bytes)
+	b = append(b, raw[4+oldNumSize:4+oldNumSize+additionalBytes]...)
+
+	// (new crc8)
+	crcHeader.Write(b)
+	b = append(b, crcHeader.Sum8())
+
+	// (rest of frame)
+	b = append(b, raw[4+oldNumSize+additionalBytes+1:len(raw)-2]...)
+
+	// (new crc16)
+	crcFrame.Write(b)
+	crc16s := crcFrame.Sum16()
+	b = append(b, byte(crc16s>>8), byte(crc16s&0xff))
+
+	return b, nil
+}
+
+// variableBlocking reports whether the frame at offset of r is of a variable
+// block-size stream. The HasFixedBlockSize field of parsed frames is not used
+// as it is set by the decoder for the opposite bit.
+func variableBlocking(r io.ReaderAt, offset int64) (bool, error) {
+	b := make([]byte, 2)
+	_, err := r.ReadAt(b, offset)
+	if err != nil {
+		return false, err
+	}
+	return b[1]&1 != 0, nil
+}
+
+// frameCRCValid reports whether the CRC-16 of the raw frame is valid.
+func frameCRCValid(raw []byte) bool {
+	if len(raw) < 2 {
+		return false
+	}
+	crcFrame := crc16.NewIBM()
+	crcFrame.Write(raw[:len(raw)-2])
+	sum := crcFrame.Sum16()
+	return raw[len(raw)-2] == byte(sum>>8) && raw[len(raw)-1] == byte(sum)
+}
+
+func getUtf8Size(n uint64) (s int64) {
+	if n <= 1<<7-1 {
+		s = 1
+	} else if n <= 1<<11-1 {
+		s = 2
+	} else if n <= 1<<16-1 {
+		s = 3
+	} else if n <= 1<<21-1 {
+		s = 4
+	} else if n <= 1<<26-1 {
+		s = 5
+	} else if n <= 1<<31-1 {
+		s = 6
+	} else {
+		s = 7
+	}
+	return
+}
+
+func encodeUtf8(n uint64) []byte {
+	b := make([]byte, 7)
+	if n <= 1<<7-1 {
+		b[0] = byte(n & 0x7F)
+		return b[:1]
+
+	} else if n <= 1<<11-1 {
+		b[0] = byte(n>>6&0x1F | 0xC0)
+		b[1] = byte(n&0x3F | 0x80)
+		return b[:2]
+
+	} else if n <= 1<<16-1 {
+		b[0] = byte(n>>12&0x0F | 0xE0)
+		b[1] = byte(n>>6&0x3F | 0x80)
+		b[2] = byte(n&0x3F | 0x80)
+		return b[:3]
+
+	} else if n <= 1<<21-1 {
+		b[0] = byte(n>>18&0x07 | 0xF0)
+		b[1] = byte(n>>12&0x3F | 0x80)
+		b[2] = byte(n>>6&0x3F | 0x80)
+		b[3] = byte(n&0x3F | 0x80)
+		return b[:4]
+
+	} else if n <= 1<<26-1 {
+		b[0] = byte(n>>24&0x03 | 0xF8)
+		b[1] = byte(n>>18&0x3F | 0x80)
+		b[2] = byte(n>>12&0x3F | 0x80)
+		b[3] = byte(n>>6&0x3F | 0x80)
+		b[4] = byte(n&0x3F | 0x80)
+		return b[:5]
+
+	} else if n <= 1<<31-1 {
+		b[0] = byte(n>>30&0x01 | 0xFC)
+		b[1] = byte(n>>24&0x3F | 0x80)
+		b[2] = byte(n>>18&0x3F | 0x80)
+		b[3] = byte(n>>12&0x3F | 0x80)
+		b[4] = byte(n>>6&0x3F | 0x80)
+		b[5] = byte(n&0x3F | 0x80)
+		return b[:6]
+
+	} else {
+		b[0] = byte(0xFE)
+		b[1] = byte(n>>30&0x3F | 0x80)
+		b[2] = byte(n>>24&0x3F | 0x80)
+		b[3] = byte(n>>18&0x3F | 0x80)
+		b[4] = byte(n>>12&0x3F | 0x80)
+		b[5] = byte(n>>6&0x3F | 0x80)
+		b[6] = byte(n&0x3F | 0x80)
+		return b[:7]
+
+	}
+
+}
@@ -0,0 +1,165 @@
+package merge
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mewkiz/flac/meta"
+	"github.com/sdidyk/flac2one/flac"
+)
+
+// Format is the audio format of a FLAC stream. Only streams of the same
+// format can be merged.
+type Format struct {
+	SampleRate    uint32
+	NChannels     uint8
+	BitsPerSample uint8
+}
+
+func (f Format) String() string {
+	return fmt.Sprintf("%d Hz, %d bit, %d channels", f.SampleRate, f.BitsPerSample, f.NChannels)
+}
+
+// FileInfo is the format and the tags of a FLAC file.
+type FileInfo struct {
+	Path   string
+	Format Format
+	Tags   [][2]string
+	// Pregap marks the pregap of the file following it; SortFiles keeps
+	// it there.
+	Pregap bool
+}
+
+// ReadFileInfo reads the metadata of the FLAC file at path.
+func ReadFileInfo(path string) (*FileInfo, error) {
+	stream, err := flac.ParseFile(path)
+	if err != nil {
+		return nil, inputError(path, err)
+	}
+	defer stream.Close()
+
+	info := &FileInfo{
+		Path: path,
+		Format: Format{
+			SampleRate:    stream.Info.SampleRate,
+			NChannels:     stream.Info.NChannels,
+			BitsPerSample: stream.Info.BitsPerSample,
+		},
+	}
+	for _, block := range stream.Blocks {
+		if body, ok := block.Body.(*meta.VorbisComment); ok {
+			info.Tags = append(info.Tags, body.Tags...)
+		}
+	}
+	return info, nil
+}
+
+// Tag returns the first value of the tag name (case-insensitive).
+func (info *FileInfo) Tag(name string) string {
+	for _, tag := range info.Tags {
+		if strings.EqualFold(tag[0], name) {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// Group is a list of FLAC files which can be merged into one stream.
+type Group struct {
+	Format Format
+	Album  string
+	// Dir and AlbumArtist are set only for albums found by FindAlbums.
+	Dir         string
+	AlbumArtist string
+	Files       []*FileInfo
+}
+
+func (g *Group) same(key *Group) bool {
+	return g.Format == key.Format && g.Album == key.Album && g.Dir == key.Dir &&
+		g.AlbumArtist == key.AlbumArtist
+}
+
+// GroupFiles splits the FLAC files at paths into groups of the same format
+// and ALBUM tag. Groups are ordered by their first file; files keep their
+// order within a group.
+func GroupFiles(paths []string) ([]*Group, error) {
+	var groups []*Group
+	for _, path := range paths {
+		info, err := ReadFileInfo(path)
+		if err != nil {
+			return nil, err
+		}
+		groups = addToGroup(groups, &Group{Format: info.Format, Album: info.Tag("ALBUM")}, info)
+	}
+	return groups, nil
+}
+
+// FindAlbums walks the directory tree at root and groups the FLAC files into
+// albums by directory, format and tags ALBUM and ALBUMARTIST. Files of an
+// album are ordered by SortFiles; use SplitDiscs to split it into discs.
+// Directories holding files which can not be read are skipped with all their
+// albums; the errors are returned in skipped.
+func FindAlbums(root string) (groups []*Group, skipped []error, err error) {
+	bad := make(map[string]bool)
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			skipped = append(skipped, err)
+			if fi != nil && fi.IsDir() {
+				return filepath.SkipDir
+			}
+			bad[filepath.Dir(path)] = true
+			return nil
+		}
+		if fi.IsDir() || !strings.EqualFold(filepath.Ext(path), ".flac") {
+			return nil
+		}
+		info, err := ReadFileInfo(path)
+		if err != nil {
+			skipped = append(skipped, err)
+			bad[filepath.Dir(path)] = true
+			return nil
+		}
+		albumArtist := info.Tag("ALBUMARTIST")
+		if albumArtist == "" {
+			albumArtist = info.Tag("ALBUM ARTIST")
+		}
+		groups = addToGroup(groups, &Group{
+			Format:      info.Format,
+			Album:       info.Tag("ALBUM"),
+			Dir:         filepath.Dir(path),
+			AlbumArtist: albumArtist,
+		}, info)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// drop albums of bad directories and order tracks
+	n := 0
+	for _, g := range groups {
+		if bad[g.Dir] {
+			continue
+		}
+		SortFiles(g.Files)
+		groups[n] = g
+		n++
+	}
+	return groups[:n], skipped, nil
+}
+
+func addToGroup(groups []*Group, key *Group, info *FileInfo) []*Group {
+	for _, g := range groups {
+		if g.same(key) {
+			g.Files = append(g.Files, info)
+			return groups
+		}
+	}
+	key.Files = []*FileInfo{info}
+	return append(groups, key)
+}
@@ -0,0 +1,131 @@
+package merge
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGroupFiles(t *testing.T) {
+	dir := t.TempDir()
+	streams := []*testStream{
+		newTestStream("One", 1000, 256, 0),
+		newTestStream("Two", 1000, 256, 0),
+		newTestStream("Three", 1000, 256, 0),
+		newTestStream("Four", 1000, 256, 0),
+	}
+	streams[1].data[4+16] ^= 1 << 1 // mono
+	streams[2].data = bytes.Replace(streams[2].data, []byte("ALBUM=Album"), []byte("ALBUM=Other"), 1)
+
+	var paths []string
+	for i, ts := range streams {
+		path := filepath.Join(dir, string(rune('a'+i))+".flac")
+		if err := ioutil.WriteFile(path, ts.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	groups, err := GroupFiles(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		album    string
+		channels uint8
+		files    []string
+	}{
+		{"Album", 2, []string{paths[0], paths[3]}},
+		{"Album", 1, []string{paths[1]}},
+		{"Other", 2, []string{paths[2]}},
+	}
+	if len(groups) != len(want) {
+		t.Fatalf("got %d groups, want %d", len(groups), len(want))
+	}
+	for i, g := range groups {
+		if g.Album != want[i].album || g.Format.NChannels != want[i].channels {
+			t.Errorf("group %d: got %q (%v)", i, g.Album, g.Format)
+		}
+		if len(g.Files) != len(want[i].files) {
+			t.Errorf("group %d: got %d files, want %d", i, len(g.Files), len(want[i].files))
+			continue
+		}
+		for j, info := range g.Files {
+			if info.Path != want[i].files[j] {
+				t.Errorf("group %d file %d: got %s, want %s", i, j, info.Path, want[i].files[j])
+			}
+		}
+	}
+
+	// errors name the file once
+	bad := filepath.Join(dir, "bad.flac")
+	if err := ioutil.WriteFile(bad, []byte("bad"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = GroupFiles(append(paths, bad))
+	var parseErr *InputParseError
+	if !errors.As(err, &parseErr) || parseErr.Path != bad || strings.Count(err.Error(), "bad.flac") != 1 {
+		t.Errorf("expected InputParseError for %s, got %v", bad, err)
+	}
+}
+
+func TestFindAlbums(t *testing.T) {
+	root := t.TempDir()
+	files := []struct {
+		path  string
+		title string
+		tags  [][2]string
+	}{
+		{"A/01.flac", "Two", [][2]string{{"TRACKNUMBER", "2/3"}}},
+		{"A/02.flac", "One", [][2]string{{"TRACKNUMBER", "1/3"}}},
+		{"A/03.flac", "Three", [][2]string{{"TRACKNUMBER", "3/3"}, {"DISCNUMBER", "2"}}},
+		{"B/01.flac", "One", nil},
+		{"B/cover.jpg", "", nil},
+		{"C/01.flac", "One", nil},
+		{"C/02.flac", "", nil},
+	}
+	for _, f := range files {
+		path := filepath.Join(root, filepath.FromSlash(f.path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		data := newTestStream(f.title, 1000, 256, 0, f.tags...).data
+		if f.title == "" {
+			data = []byte("not a FLAC file")
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	groups, skipped, err := FindAlbums(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// album in C is skipped for its bad file
+	var parseErr *InputParseError
+	if len(skipped) != 1 || !errors.As(skipped[0], &parseErr) || filepath.Base(parseErr.Path) != "02.flac" {
+		t.Errorf("got skipped %v, want error for C/02.flac", skipped)
+	}
+	want := [][]string{{"A/02.flac", "A/01.flac", "A/03.flac"}, {"B/01.flac"}}
+	if len(groups) != len(want) {
+		t.Fatalf("got %d albums, want %d", len(groups), len(want))
+	}
+	for i, g := range groups {
+		var got []string
+		for _, info := range g.Files {
+			rel, _ := filepath.Rel(root, info.Path)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		if strings.Join(got, " ") != strings.Join(want[i], " ") {
+			t.Errorf("album %d: got %v, want %v", i, got, want[i])
+		}
+	}
+	if discs := SplitDiscs(groups[0].Files); len(discs) != 2 || len(discs[1]) != 1 {
+		t.Errorf("album 0: got %d discs, want 2", len(discs))
+	}
+}
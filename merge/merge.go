@@ -0,0 +1,558 @@
+// Package merge concatenates FLAC streams into one FLAC stream without
+// re-encoding the audio, and generates a CUE-sheet for the result.
+package merge
+
+import (
+	"bufio"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mewkiz/flac/meta"
+	"github.com/sdidyk/flac2one/flac"
+)
+
+// Vendor is the vendor string of written VORBIS_COMMENT blocks.
+const Vendor = "flac2one"
+
+var errPregap = errors.New("pregap is not followed by a track")
+var errDryRun = errors.New("merged stream is not available in dry run")
+var errStopped = errors.New("scan stopped")
+
+// Options configures a Merger.
+type Options struct {
+	// CueSheet embeds a CUESHEET metadata block. It is left out for more
+	// than MaxCueSheetTracks tracks.
+	CueSheet bool
+	// CueTags embeds the CUE-sheet and track titles into tags.
+	CueTags bool
+	// RoundTime rounds CUE-sheet times to the nearest CD frame instead of
+	// truncating them.
+	RoundTime bool
+	// DryRun reads only metadata of added streams. Track positions and sizes
+	// are taken from STREAMINFO and the merged stream can not be written.
+	DryRun bool
+	// Fast finds frames without decoding them. The MD5 sum of the merged
+	// stream is unknown and written as zeros. Split ignores it.
+	Fast bool
+	// Workers is the number of files decoded in parallel by AddFiles
+	// (defaults to the number of CPUs).
+	Workers int
+	// SeekTable sets the seek points of the merged stream.
+	SeekTable SeekTable
+	// Pictures selects the pictures taken from added streams.
+	Pictures PictureMode
+	// Padding sets the PADDING block, which is always the last block.
+	Padding Padding
+	// TagsFirst writes VORBIS_COMMENT directly after STREAMINFO, before
+	// SEEKTABLE and CUESHEET. PICTURE blocks always follow them.
+	TagsFirst bool
+}
+
+// Track is a track of the merged stream.
+type Track struct {
+	Title      string
+	Performer  string
+	Songwriter string
+	ISRC       string
+	Composer   string
+	Comment    string
+	// Offset is the number of the first sample of the track (INDEX 01).
+	Offset uint64
+	// Pregap is the number of samples of the pregap (INDEX 00) before
+	// Offset.
+	Pregap uint64
+}
+
+// Merger concatenates FLAC streams. Stream format and album tags are taken
+// from the first added stream, pictures as set by Options.Pictures.
+//
+// Added streams are scanned for frame positions and STREAMINFO first; their
+// frames are copied directly to the output by WriteTo.
+type Merger struct {
+	Options Options
+
+	SampleRate    uint32
+	NChannels     uint8
+	BitsPerSample uint8
+
+	Album       string
+	Artist      string
+	AlbumArtist string
+	Date        string
+	Genre       string
+	// Disc is the DISCNUMBER shared by all streams, or 0.
+	Disc       int
+	TotalDiscs int
+	// Tags are additional tags of the VORBIS_COMMENT block.
+	Tags     [][2]string
+	Tracks   []Track
+	Pictures []*meta.Picture
+	// File is the name of the merged file in the embedded CUE-sheet.
+	File string
+
+	blockSizeMin, blockSizeMax uint16
+	lastBlockSize              uint16
+	// variable is set once the frames can not form a fixed block-size
+	// stream; sizes of the rewritten frames are counted for both
+	variable                  bool
+	variableSizes, fixedSizes frameSizes
+	// totalBytes is the size of the audio of added streams in dry run
+	totalBytes, totalSamples uint64
+	totalFrames              uint64
+	pregap                   uint64
+	md5sum                   hash.Hash
+	sources                  []*source
+}
+
+// source is an added stream whose frames are copied by WriteTo.
+type source struct {
+	// path of the file reopened by WriteTo, or empty if ra is used
+	path   string
+	ra     io.ReaderAt
+	info   *meta.StreamInfo
+	frames []frameRef
+	// first sample and number of samples in merged stream
+	start, samples uint64
+}
+
+// frameSizes are statistics of rewritten frames.
+type frameSizes struct {
+	min, max uint32
+	total    uint64
+}
+
+func (s *frameSizes) add(size uint32) {
+	if s.total == 0 || size < s.min {
+		s.min = size
+	}
+	if size > s.max {
+		s.max = size
+	}
+	s.total += uint64(size)
+}
+
+// frameRef is the position of a frame in its source.
+type frameRef struct {
+	offset int64
+	size   uint32
+	// coded number in source and sample number in merged stream
+	num, sampleNum uint64
+}
+
+// New returns an empty Merger.
+func New(opts Options) *Merger {
+	return &Merger{
+		Options:      opts,
+		blockSizeMin: 65535,
+		md5sum:       md5.New(),
+	}
+}
+
+// TotalSamples returns the number of samples of the merged stream.
+func (m *Merger) TotalSamples() uint64 {
+	return m.totalSamples
+}
+
+// Size returns the size of the merged stream in bytes. In dry run it is
+// estimated from the sizes of added streams.
+func (m *Merger) Size() int64 {
+	return int64(len(m.header())) + int64(m.totalBytes) + int64(m.sizes().total)
+}
+
+// Fixed reports whether the merged stream keeps fixed block size: all added
+// streams are fixed block-size with the same block size and only the last
+// frame is shorter. Otherwise it is variable block-size.
+func (m *Merger) Fixed() bool {
+	return !m.variable && m.totalFrames > 0
+}
+
+// sizes returns the statistics of the frames as written by WriteTo.
+func (m *Merger) sizes() frameSizes {
+	if m.Fixed() {
+		return m.fixedSizes
+	}
+	return m.variableSizes
+}
+
+// codedNum returns the coded number of a frame as written by WriteTo: the
+// frame number in a fixed block-size stream, else the sample number.
+func (m *Merger) codedNum(fr frameRef) uint64 {
+	if m.Fixed() {
+		return fr.sampleNum / uint64(m.blockSizeMax)
+	}
+	return fr.sampleNum
+}
+
+// AddFile appends the FLAC file at path as a new track.
+func (m *Merger) AddFile(path string) error {
+	return m.addFile(path, false)
+}
+
+// AddPregapFile appends the FLAC file at path as the pregap of the next track.
+func (m *Merger) AddPregapFile(path string) error {
+	return m.addFile(path, true)
+}
+
+func (m *Merger) addFile(path string, pregap bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return inputError(path, err)
+	}
+	defer f.Close()
+	return m.add(f, path, pregap)
+}
+
+// Add appends the FLAC stream of r as a new track. A stream with a true
+// PREGAP tag is added as the pregap of the next track. Frames are read from
+// r again by WriteTo.
+func (m *Merger) Add(r io.ReadSeeker) error {
+	return m.add(r, "", false)
+}
+
+// AddPregap appends the FLAC stream of r as the pregap of the next track.
+func (m *Merger) AddPregap(r io.ReadSeeker) error {
+	return m.add(r, "", true)
+}
+
+// add appends the stream of r read from the file at path. Errors are
+// InputParseError or FormatMismatchError.
+func (m *Merger) add(r io.ReadSeeker, path string, pregap bool) error {
+	return inputError(path, m.addStream(r, path, pregap))
+}
+
+func (m *Merger) addStream(r io.ReadSeeker, path string, pregap bool) (err error) {
+	stream, err := flac.Parse(r)
+	if err != nil {
+		return err
+	}
+	trackStart, pregap, err := m.addHeader(stream, pregap)
+	if err != nil {
+		return err
+	}
+
+	if m.Options.DryRun {
+		start, err := stream.Pos()
+		if err != nil {
+			return err
+		}
+		if stream.Info.NSamples == 0 {
+			return fmt.Errorf("unknown number of samples in STREAMINFO")
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		m.totalSamples += stream.Info.NSamples
+		m.totalBytes += uint64(end - start)
+		if stream.Info.BlockSizeMax > m.blockSizeMax {
+			m.blockSizeMax = stream.Info.BlockSizeMax
+		}
+		if pregap {
+			m.pregap += stream.Info.NSamples
+		}
+		return nil
+	}
+
+	var frames []scannedFrame
+	if m.Options.Fast {
+		frames, err = scanStreamFast(stream, r, nil)
+	} else {
+		frames, err = scanFrames(stream, m.md5sum, nil)
+	}
+	if err != nil {
+		return err
+	}
+	m.addFrames(&source{path: path, ra: stream, info: stream.Info}, frames, trackStart, pregap)
+	return nil
+}
+
+// addHeader checks the format of stream and takes its tags and picture. It
+// returns the first sample of the stream in the merged stream and whether
+// the stream is a pregap.
+func (m *Merger) addHeader(stream *flac.Stream, pregap bool) (trackStart uint64, isPregap bool, err error) {
+	first := len(m.Tracks) == 0
+
+	// check info
+	if m.SampleRate == 0 {
+		m.SampleRate = stream.Info.SampleRate
+		m.NChannels = stream.Info.NChannels
+		m.BitsPerSample = stream.Info.BitsPerSample
+	} else {
+		if m.SampleRate != stream.Info.SampleRate {
+			return 0, false, &FormatMismatchError{Field: "sample rate", Expected: m.SampleRate, Got: stream.Info.SampleRate}
+		}
+		if m.NChannels != stream.Info.NChannels {
+			return 0, false, &FormatMismatchError{Field: "num of channels", Expected: uint32(m.NChannels), Got: uint32(stream.Info.NChannels)}
+		}
+		if m.BitsPerSample != stream.Info.BitsPerSample {
+			return 0, false, &FormatMismatchError{Field: "bits per sample", Expected: uint32(m.BitsPerSample), Got: uint32(stream.Info.BitsPerSample)}
+		}
+	}
+
+	// get meta
+	track := Track{Offset: m.totalSamples}
+	disc := 0
+	for _, block := range stream.Blocks {
+		switch body := block.Body.(type) {
+		// tags: parse
+		case *meta.VorbisComment:
+			for _, tag := range body.Tags {
+				switch strings.ToUpper(tag[0]) {
+				case "ALBUM":
+					if first {
+						m.Album = tag[1]
+					}
+				case "ARTIST":
+					if first {
+						m.Artist = tag[1]
+					}
+					track.Performer = tag[1]
+				case "ALBUMARTIST", "ALBUM ARTIST":
+					if first {
+						m.AlbumArtist = tag[1]
+					}
+				case "DATE":
+					if first {
+						m.Date = tag[1]
+					}
+				case "GENRE":
+					if first {
+						m.Genre = tag[1]
+					}
+				case "DISCNUMBER":
+					var total int
+					disc, total = splitNumber(tag[1])
+					if first && total > 0 {
+						m.TotalDiscs = total
+					}
+				case "TOTALDISCS", "DISCTOTAL":
+					if first {
+						m.TotalDiscs, _ = splitNumber(tag[1])
+					}
+				case "TITLE":
+					track.Title = tag[1]
+				case "SONGWRITER":
+					track.Songwriter = tag[1]
+				case "ISRC":
+					track.ISRC = tag[1]
+				case "COMPOSER":
+					track.Composer = tag[1]
+				case "COMMENT", "DESCRIPTION":
+					track.Comment = tag[1]
+				case "PREGAP":
+					switch strings.ToLower(tag[1]) {
+					case "", "0", "no", "false":
+					default:
+						pregap = true
+					}
+				}
+			}
+
+		case *meta.Picture:
+			m.addPicture(body, first)
+		}
+	}
+	if first {
+		m.Disc = disc
+	} else if disc != m.Disc {
+		m.Disc = 0
+	}
+	if !pregap {
+		track.Pregap = m.pregap
+		m.pregap = 0
+		m.Tracks = append(m.Tracks, track)
+	}
+
+	return track.Offset, pregap, nil
+}
+
+// scannedFrame is a frame found by scanFrames.
+type scannedFrame struct {
+	start, next int64
+	num         uint64
+	blockSize   uint16
+	// variable is set for frames of variable block-size streams
+	variable bool
+}
+
+// scanFrames parses the frames of stream and writes their samples to md5sum.
+// It fails with errStopped once stop is closed.
+func scanFrames(stream *flac.Stream, md5sum hash.Hash, stop <-chan struct{}) ([]scannedFrame, error) {
+	start, err := stream.Pos()
+	if err != nil {
+		return nil, err
+	}
+	var frames []scannedFrame
+	variable := false
+	for {
+		select {
+		case <-stop:
+			return nil, errStopped
+		default:
+		}
+
+		frame, err := stream.ParseNext()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, &InputParseError{Frame: len(frames), Err: err}
+		}
+		if len(frames) == 0 {
+			variable, err = variableBlocking(stream, start)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// update md5
+		frame.Hash(md5sum)
+
+		// get frame size
+		next, err := stream.Pos()
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, scannedFrame{start, next, frame.Num, frame.BlockSize, variable})
+
+		// next iteration
+		start = next
+	}
+	return frames, nil
+}
+
+// addFrames appends the scanned frames of src. The stream starts at sample
+// trackStart of the merged stream.
+func (m *Merger) addFrames(src *source, frames []scannedFrame, trackStart uint64, pregap bool) {
+	m.sources = append(m.sources, src)
+	src.start = m.totalSamples
+	for _, frame := range frames {
+		m.addFrame(frame)
+	}
+	src.samples = m.totalSamples - src.start
+	if pregap {
+		m.pregap += m.totalSamples - trackStart
+	}
+}
+
+// addFrame appends the frame to the last source. Stream totals and frame
+// statistics are updated accordingly.
+func (m *Merger) addFrame(frame scannedFrame) {
+	src := m.sources[len(m.sources)-1]
+	src.frames = append(src.frames, frameRef{
+		offset:    frame.start,
+		size:      uint32(frame.next - frame.start),
+		num:       frame.num,
+		sampleNum: m.totalSamples,
+	})
+
+	// only the last frame of a fixed block-size stream may be shorter
+	if frame.variable || m.totalFrames > 0 &&
+		(m.lastBlockSize != m.blockSizeMax || frame.blockSize > m.blockSizeMax) {
+		m.variable = true
+	}
+	m.lastBlockSize = frame.blockSize
+
+	// size of the frame with the sample or frame number instead of its
+	// coded number
+	size := uint32(frame.next-frame.start) - uint32(getUtf8Size(frame.num))
+	m.variableSizes.add(size + uint32(getUtf8Size(m.totalSamples)))
+	m.fixedSizes.add(size + uint32(getUtf8Size(m.totalFrames)))
+
+	// update min and max
+	if frame.blockSize < m.blockSizeMin {
+		m.blockSizeMin = frame.blockSize
+	}
+	if frame.blockSize > m.blockSizeMax {
+		m.blockSizeMax = frame.blockSize
+	}
+
+	// update totals
+	m.totalSamples += uint64(frame.blockSize)
+	m.totalFrames++
+}
+
+// WriteTo writes the merged FLAC stream to w.
+func (m *Merger) WriteTo(w io.Writer) (n int64, err error) {
+	if m.Options.DryRun {
+		return 0, errDryRun
+	}
+	if m.totalFrames == 0 {
+		return 0, fmt.Errorf("no audio frames")
+	}
+	if m.pregap > 0 {
+		return 0, errPregap
+	}
+
+	header := m.header()
+	nn, err := w.Write(header)
+	n += int64(nn)
+	if err != nil {
+		return n, writeError(w, err)
+	}
+
+	// copy frames
+	for _, src := range m.sources {
+		copied, err := m.writeFrames(w, src)
+		n += copied
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// writeFrames writes the rewritten frames of src to w. Errors of reading src
+// are InputParseError, errors of writing are OutputWriteError.
+func (m *Merger) writeFrames(w io.Writer, src *source) (n int64, err error) {
+	if len(src.frames) == 0 {
+		return 0, nil
+	}
+	ra := src.ra
+	if src.path != "" {
+		f, err := os.Open(src.path)
+		if err != nil {
+			return 0, inputError(src.path, err)
+		}
+		defer f.Close()
+		ra = f
+	}
+
+	// frames of a source are contiguous
+	first, last := src.frames[0], src.frames[len(src.frames)-1]
+	r := bufio.NewReader(io.NewSectionReader(ra, first.offset, last.offset+int64(last.size)-first.offset))
+	var raw []byte
+	for i, fr := range src.frames {
+		if cap(raw) < int(fr.size) {
+			raw = make([]byte, fr.size)
+		}
+		raw = raw[:fr.size]
+		_, err = io.ReadFull(r, raw)
+		if err != nil {
+			return n, &InputParseError{src.path, i, err}
+		}
+		if !frameCRCValid(raw) {
+			return n, &InputParseError{src.path, i, fmt.Errorf("frame changed since it was added")}
+		}
+		b, err := rewriteFrame(raw, fr.num, m.codedNum(fr), !m.Fixed())
+		if err != nil {
+			return n, &InputParseError{src.path, i, err}
+		}
+		nn, err := w.Write(b)
+		n += int64(nn)
+		if err != nil {
+			return n, writeError(w, err)
+		}
+	}
+	return n, nil
+}
+
+// Close releases the added streams of m.
+func (m *Merger) Close() error {
+	m.sources = nil
+	return nil
+}
@@ -0,0 +1,403 @@
+package merge
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/mewkiz/flac/meta"
+	"github.com/sdidyk/flac2one/flac"
+	"github.com/sdidyk/flac2one/hashutil/crc16"
+	"github.com/sdidyk/flac2one/hashutil/crc8"
+)
+
+// testStream is a generated 44.1 kHz, 16 bit, stereo FLAC stream.
+type testStream struct {
+	data []byte
+	// pcm holds the samples as hashed for MD5
+	pcm []byte
+}
+
+// newTestStream generates a stream of n samples with fixed blocksize frames
+// of verbatim subframes. Tags are added to ALBUM, ARTIST and TITLE.
+func newTestStream(title string, n, blockSize int, seed int16, tags ...[2]string) *testStream {
+	ts := new(testStream)
+	md5sum := md5.New()
+	var frames bytes.Buffer
+	for num, pos := 0, 0; pos < n; num, pos = num+1, pos+blockSize {
+		size := blockSize
+		if n-pos < size {
+			size = n - pos
+		}
+
+		// header: fixed blocksize, 16 bit blocksize, 44.1 kHz, stereo, 16 bit
+		b := []byte{0xFF, 0xF8, 0x79, 0x18}
+		b = append(b, encodeUtf8(uint64(num))...)
+		b = append(b, byte((size-1)>>8), byte(size-1))
+		h8 := crc8.NewATM()
+		h8.Write(b)
+		b = append(b, h8.Sum8())
+
+		// verbatim subframes
+		samples := make([][]int16, 2)
+		for ch := range samples {
+			b = append(b, 0x02)
+			for i := 0; i < size; i++ {
+				v := seed + int16(ch*1000+pos+i)
+				samples[ch] = append(samples[ch], v)
+				b = append(b, byte(uint16(v)>>8), byte(v))
+			}
+		}
+		for i := 0; i < size; i++ {
+			for ch := range samples {
+				v := uint16(samples[ch][i])
+				ts.pcm = append(ts.pcm, byte(v), byte(v>>8))
+			}
+		}
+		h16 := crc16.NewIBM()
+		h16.Write(b)
+		sum := h16.Sum16()
+		b = append(b, byte(sum>>8), byte(sum))
+		frames.Write(b)
+	}
+	md5sum.Write(ts.pcm)
+
+	var buf bytes.Buffer
+	buf.WriteString("fLaC")
+
+	// STREAMINFO
+	si := make([]byte, 4+34)
+	si[3] = 34
+	si[4], si[5] = byte(blockSize>>8), byte(blockSize)
+	si[6], si[7] = byte(blockSize>>8), byte(blockSize)
+	rate := 44100
+	si[14] = byte(rate >> 12)
+	si[15] = byte(rate >> 4)
+	si[16] = byte(rate&15<<4) | 1<<1
+	si[17] = 15 << 4
+	encUint32(si[18:], uint32(n))
+	copy(si[22:], md5sum.Sum(nil))
+	buf.Write(si)
+
+	// VORBIS_COMMENT
+	comment := &meta.VorbisComment{
+		Vendor: "test",
+		Tags: [][2]string{
+			{"ALBUM", "Album"},
+			{"ARTIST", "Artist"},
+			{"TITLE", title},
+		},
+	}
+	comment.Tags = append(comment.Tags, tags...)
+	size := vorbisCommentSize(comment)
+	vc := make([]byte, 4+size)
+	vc[0] = 1<<7 | byte(meta.TypeVorbisComment)
+	vc[1], vc[2], vc[3] = byte(size>>16), byte(size>>8), byte(size)
+	encVorbisComment(vc[4:], comment)
+	buf.Write(vc)
+
+	buf.Write(frames.Bytes())
+	ts.data = buf.Bytes()
+	return ts
+}
+
+// checkStream parses a FLAC stream, verifies all frames and returns it.
+func checkStream(t *testing.T, data []byte, pcm []byte) *flac.Stream {
+	stream, err := flac.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md5sum := md5.New()
+	samples := uint64(0)
+	start, err := stream.Pos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed := data[start+1]&1 == 0
+	for i := uint64(0); ; i++ {
+		frame, err := stream.ParseNext()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("frame at sample %d: %v", samples, err)
+		}
+		if fixed && frame.Num != i {
+			t.Errorf("frame number; expected %d, got %d", i, frame.Num)
+		}
+		if !fixed && frame.Num != samples {
+			t.Errorf("sample number; expected %d, got %d", samples, frame.Num)
+		}
+		frame.Hash(md5sum)
+		samples += uint64(frame.BlockSize)
+	}
+	if samples != stream.Info.NSamples {
+		t.Errorf("total samples; expected %d, got %d", stream.Info.NSamples, samples)
+	}
+	want := md5.Sum(pcm)
+	if !bytes.Equal(stream.Info.MD5sum[:], want[:]) || !bytes.Equal(md5sum.Sum(nil), want[:]) {
+		t.Errorf("md5 mismatch")
+	}
+	return stream
+}
+
+func findComment(stream *flac.Stream) *meta.VorbisComment {
+	for _, block := range stream.Blocks {
+		if vc, ok := block.Body.(*meta.VorbisComment); ok {
+			return vc
+		}
+	}
+	return nil
+}
+
+func mergeTestStreams(t *testing.T, opts Options, streams ...*testStream) *Merger {
+	m := New(opts)
+	for _, ts := range streams {
+		err := m.Add(bytes.NewReader(ts.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func TestMerge(t *testing.T) {
+	a := newTestStream("One", 10000, 4096, 0)
+	b := newTestStream("Two", 5000, 4096, 100)
+	m := mergeTestStreams(t, Options{CueTags: true}, a, b)
+	m.File = "Artist - Album.flac"
+
+	if m.Album != "Album" || m.Artist != "Artist" {
+		t.Errorf("album tags; got %q, %q", m.Album, m.Artist)
+	}
+	want := []Track{
+		{Title: "One", Performer: "Artist", Offset: 0},
+		{Title: "Two", Performer: "Artist", Offset: 10000},
+	}
+	if len(m.Tracks) != len(want) || m.Tracks[0] != want[0] || m.Tracks[1] != want[1] {
+		t.Errorf("tracks; expected %v, got %v", want, m.Tracks)
+	}
+
+	var out bytes.Buffer
+	n, err := m.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(out.Len()) {
+		t.Errorf("written bytes; expected %d, got %d", out.Len(), n)
+	}
+	stream := checkStream(t, out.Bytes(), append(append([]byte{}, a.pcm...), b.pcm...))
+	if stream.Info.NSamples != 15000 {
+		t.Errorf("total samples; expected 15000, got %d", stream.Info.NSamples)
+	}
+
+	vc := findComment(stream)
+	if vc == nil {
+		t.Fatal("no VORBIS_COMMENT block")
+	}
+	tags := make(map[string]string)
+	for _, tag := range vc.Tags {
+		tags[tag[0]] = tag[1]
+	}
+	if tags["ALBUM"] != "Album" || tags["TRACK02_TITLE"] != "Two" {
+		t.Errorf("unexpected tags %q", vc.Tags)
+	}
+	if !strings.Contains(tags["CUESHEET"], "FILE \"Artist - Album.flac\" WAVE") {
+		t.Errorf("unexpected CUESHEET tag %q", tags["CUESHEET"])
+	}
+}
+
+func TestMergeMismatch(t *testing.T) {
+	a := newTestStream("One", 1000, 256, 0)
+	b := newTestStream("Two", 1000, 256, 0)
+	b.data[4+16] ^= 1 << 1 // mono
+	m := New(Options{})
+	if err := m.Add(bytes.NewReader(a.data)); err != nil {
+		t.Fatal(err)
+	}
+	err := m.Add(bytes.NewReader(b.data))
+	var formatErr *FormatMismatchError
+	if !errors.As(err, &formatErr) || formatErr.Field != "num of channels" || formatErr.Expected != 2 || formatErr.Got != 1 {
+		t.Errorf("expected channels mismatch error, got %v", err)
+	}
+
+	// dry run
+	m = New(Options{DryRun: true})
+	if err := m.Add(bytes.NewReader(a.data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(bytes.NewReader(b.data)); err == nil {
+		t.Error("expected channels mismatch error in dry run")
+	}
+}
+
+func TestMergeFixed(t *testing.T) {
+	a := newTestStream("One", 8192, 4096, 0)
+	b := newTestStream("Two", 5000, 4096, 100)
+	for _, fast := range []bool{false, true} {
+		m := mergeTestStreams(t, Options{Fast: fast}, a, b)
+		if !m.Fixed() {
+			t.Fatal("expected fixed block-size result")
+		}
+		var out bytes.Buffer
+		if _, err := m.WriteTo(&out); err != nil {
+			t.Fatal(err)
+		}
+		if err := Verify(bytes.NewReader(out.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		if int64(out.Len()) != m.Size() {
+			t.Errorf("size; expected %d, got %d", m.Size(), out.Len())
+		}
+		if fast {
+			continue
+		}
+		stream := checkStream(t, out.Bytes(), append(a.pcm, b.pcm...))
+		if stream.Info.BlockSizeMin != 4096 || stream.Info.BlockSizeMax != 4096 {
+			t.Errorf("block size; expected 4096, got %d-%d", stream.Info.BlockSizeMin, stream.Info.BlockSizeMax)
+		}
+	}
+
+	// a shorter frame before the last one needs variable block size
+	if m := mergeTestStreams(t, Options{}, b, a); m.Fixed() {
+		t.Error("expected variable block-size result")
+	}
+}
+
+func TestMergeChanged(t *testing.T) {
+	a := newTestStream("One", 1000, 256, 0)
+	m := mergeTestStreams(t, Options{}, a)
+	a.data[len(a.data)-1] ^= 1
+	_, err := m.WriteTo(ioutil.Discard)
+	var parseErr *InputParseError
+	if !errors.As(err, &parseErr) || parseErr.Frame != 3 {
+		t.Errorf("expected error for changed frame 3, got %v", err)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	a := newTestStream("One", 10000, 4096, 0)
+	b := newTestStream("Two", 5000, 4096, 100)
+	m := mergeTestStreams(t, Options{}, a, b)
+	var image bytes.Buffer
+	if _, err := m.WriteTo(&image); err != nil {
+		t.Fatal(err)
+	}
+	var cue bytes.Buffer
+	if err := m.WriteCue(&cue, "image.flac"); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := ParseCue(&cue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][]byte
+	err = Split(bytes.NewReader(image.Bytes()), cs, Options{}, func(track CueTrack, m *Merger) error {
+		var out bytes.Buffer
+		_, err := m.WriteTo(&out)
+		got = append(got, out.Bytes())
+		if err != nil {
+			return err
+		}
+		// tracks are checked against the image
+		results, err := m.Check(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			return err
+		}
+		if len(results) != 1 || !results[0].OK() {
+			t.Errorf("track %d: check failed: %+v", track.Num, results)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("tracks; expected 2, got %d", len(got))
+	}
+	for i, ts := range []*testStream{a, b} {
+		stream := checkStream(t, got[i], ts.pcm)
+		vc := findComment(stream)
+		if vc == nil {
+			t.Fatal("no VORBIS_COMMENT block")
+		}
+		if title := cs.Tracks[i].Title; !containsTag(vc, "TITLE", title) {
+			t.Errorf("track %d: no TITLE=%s in %q", i+1, title, vc.Tags)
+		}
+	}
+}
+
+func containsTag(vc *meta.VorbisComment, name, value string) bool {
+	for _, tag := range vc.Tags {
+		if tag[0] == name && tag[1] == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMergePregap(t *testing.T) {
+	htoa := newTestStream("Hidden", 588*75, 4096, 0)
+	a := newTestStream("One", 588*150, 4096, 0)
+	gap := newTestStream("Gap", 588*30, 4096, 0)
+	b := newTestStream("Two", 588*75, 4096, 0)
+	m := New(Options{CueSheet: true})
+	for i, ts := range []*testStream{htoa, a, gap, b} {
+		add := m.Add
+		if i%2 == 0 {
+			add = m.AddPregap
+		}
+		if err := add(bytes.NewReader(ts.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []Track{
+		{Title: "One", Performer: "Artist", Offset: 588 * 75, Pregap: 588 * 75},
+		{Title: "Two", Performer: "Artist", Offset: 588 * 255, Pregap: 588 * 30},
+	}
+	if len(m.Tracks) != len(want) || m.Tracks[0] != want[0] || m.Tracks[1] != want[1] {
+		t.Errorf("tracks; expected %v, got %v", want, m.Tracks)
+	}
+
+	var cue strings.Builder
+	if err := m.WriteCue(&cue, "a.flac"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"INDEX 00 00:00:00\n    INDEX 01 00:01:00\n",
+		"INDEX 00 00:03:00\n    INDEX 01 00:03:30\n",
+	} {
+		if !strings.Contains(cue.String(), s) {
+			t.Errorf("missing %q in:\n%s", s, cue.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if _, err := m.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := flac.Parse(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range stream.Blocks {
+		if cs, ok := block.Body.(*meta.CueSheet); ok {
+			if !cs.IsCompactDisc || cs.Tracks[1].Offset != 588*225 || len(cs.Tracks[1].Indicies) != 2 {
+				t.Errorf("unexpected CUESHEET %+v", cs)
+			}
+		}
+	}
+
+	// trailing pregap
+	if err := m.AddPregap(bytes.NewReader(gap.data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteCue(&cue, "a.flac"); err == nil {
+		t.Error("expected error for trailing pregap")
+	}
+}
@@ -0,0 +1,305 @@
+package merge
+
+import (
+	"bytes"
+
+	"github.com/mewkiz/flac/meta"
+)
+
+// header returns the FLAC signature and metadata blocks of the merged stream.
+func (m *Merger) header() []byte {
+	buf := new(bytes.Buffer)
+
+	var b []byte
+	// STREAM: header
+	buf.Write([]byte("fLaC"))
+
+	// METADATA_BLOCK_HEADER: streaminfo
+	b = make([]byte, 4)
+	b[0] = byte(meta.TypeStreamInfo)
+	b[3] = 34
+	buf.Write(b)
+
+	// METADATA_BLOCK_STREAMINFO
+	b = make([]byte, 34)
+	blockSizeMin := m.blockSizeMin
+	if m.Fixed() {
+		// the last block is not counted
+		blockSizeMin = m.blockSizeMax
+	}
+	sizes := m.sizes()
+	b[0] = byte(blockSizeMin >> 8 & 255)
+	b[1] = byte(blockSizeMin & 255)
+	b[2] = byte(m.blockSizeMax >> 8 & 255)
+	b[3] = byte(m.blockSizeMax & 255)
+	b[4] = byte(sizes.min >> 16 & 255)
+	b[5] = byte(sizes.min >> 8 & 255)
+	b[6] = byte(sizes.min & 255)
+	b[7] = byte(sizes.max >> 16 & 255)
+	b[8] = byte(sizes.max >> 8 & 255)
+	b[9] = byte(sizes.max & 255)
+	b[10] = byte(m.SampleRate >> 12 & 255)
+	b[11] = byte(m.SampleRate >> 4 & 255)
+	b[12] = byte(m.SampleRate&15<<4) | byte((m.NChannels-1)<<1) | byte((m.BitsPerSample-1)>>4)
+	b[13] = byte((m.BitsPerSample-1)&15<<4) | byte(m.totalSamples>>32&255)
+	b[14] = byte(m.totalSamples >> 24 & 255)
+	b[15] = byte(m.totalSamples >> 16 & 255)
+	b[16] = byte(m.totalSamples >> 8 & 255)
+	b[17] = byte(m.totalSamples & 255)
+	if !m.Options.Fast {
+		copy(b[18:], m.md5sum.Sum(nil))
+	}
+	buf.Write(b)
+
+	// pictures and padding last
+	if m.Options.TagsFirst {
+		m.writeComment(buf)
+		m.writeSeekTable(buf)
+		m.writeCueSheet(buf)
+	} else {
+		m.writeSeekTable(buf)
+		m.writeCueSheet(buf)
+		m.writeComment(buf)
+	}
+	m.writePictures(buf)
+	m.writePadding(buf)
+
+	header := buf.Bytes()
+	setLastBlock(header)
+	return header
+}
+
+// writeSeekTable writes the SEEKTABLE block unless there are no seek points.
+func (m *Merger) writeSeekTable(buf *bytes.Buffer) {
+	var b []byte
+	seekTable := m.seekPoints()
+	if len(seekTable) > 0 {
+		// METADATA_BLOCK_HEADER: seektable
+		b = make([]byte, 4)
+		size := (8 + 8 + 2) * len(seekTable)
+		b[0] = byte(meta.TypeSeekTable)
+		b[1] = byte(size >> 16 & 255)
+		b[2] = byte(size >> 8 & 255)
+		b[3] = byte(size & 255)
+		buf.Write(b)
+
+		// METADATA_BLOCK_SEEKTABLE
+		b = make([]byte, 8+8+2)
+		for _, v := range seekTable {
+			b[0] = byte(v.SampleNum >> 56 & 255)
+			b[1] = byte(v.SampleNum >> 48 & 255)
+			b[2] = byte(v.SampleNum >> 40 & 255)
+			b[3] = byte(v.SampleNum >> 32 & 255)
+			b[4] = byte(v.SampleNum >> 24 & 255)
+			b[5] = byte(v.SampleNum >> 16 & 255)
+			b[6] = byte(v.SampleNum >> 8 & 255)
+			b[7] = byte(v.SampleNum & 255)
+			b[8] = byte(v.Offset >> 56 & 255)
+			b[9] = byte(v.Offset >> 48 & 255)
+			b[10] = byte(v.Offset >> 40 & 255)
+			b[11] = byte(v.Offset >> 32 & 255)
+			b[12] = byte(v.Offset >> 24 & 255)
+			b[13] = byte(v.Offset >> 16 & 255)
+			b[14] = byte(v.Offset >> 8 & 255)
+			b[15] = byte(v.Offset & 255)
+			b[16] = byte(v.NSamples >> 8 & 255)
+			b[17] = byte(v.NSamples & 255)
+			buf.Write(b)
+		}
+	}
+}
+
+// writeCueSheet writes the CUESHEET block if Options.CueSheet is set and the
+// tracks fit into it.
+func (m *Merger) writeCueSheet(buf *bytes.Buffer) {
+	var b []byte
+	if m.Options.CueSheet && len(m.Tracks) <= MaxCueSheetTracks {
+		// METADATA_BLOCK_HEADER: cuesheet
+		cueBlock := m.cueBlock()
+		b = make([]byte, 4)
+		size := cueSheetSize(cueBlock)
+		b[0] = byte(meta.TypeCueSheet)
+		b[1] = byte(size >> 16 & 255)
+		b[2] = byte(size >> 8 & 255)
+		b[3] = byte(size & 255)
+		buf.Write(b)
+
+		// METADATA_BLOCK_CUESHEET
+		b = make([]byte, size)
+		encCueSheet(b, cueBlock)
+		buf.Write(b)
+	}
+}
+
+// writeComment writes the VORBIS_COMMENT block.
+func (m *Merger) writeComment(buf *bytes.Buffer) {
+	// METADATA_BLOCK_HEADER: vorbis comment
+	comment := m.comment()
+	b := make([]byte, 4)
+	size := vorbisCommentSize(comment)
+	b[0] = byte(meta.TypeVorbisComment)
+	b[1] = byte(size >> 16 & 255)
+	b[2] = byte(size >> 8 & 255)
+	b[3] = byte(size & 255)
+	buf.Write(b)
+
+	// METADATA_BLOCK_VORBIS_COMMENT
+	b = make([]byte, size)
+	encVorbisComment(b, comment)
+	buf.Write(b)
+}
+
+// writePictures writes a PICTURE block for each picture.
+func (m *Merger) writePictures(buf *bytes.Buffer) {
+	var b []byte
+	for _, picture := range m.Pictures {
+		// METADATA_BLOCK_HEADER: picture
+		b = make([]byte, 4)
+		size := pictureSize(picture)
+		b[0] = byte(meta.TypePicture)
+		b[1] = byte(size >> 16 & 255)
+		b[2] = byte(size >> 8 & 255)
+		b[3] = byte(size & 255)
+		buf.Write(b)
+
+		// METADATA_BLOCK_PICTURE
+		b = make([]byte, size)
+		offset := 0
+		encUint32(b[offset:], picture.Type)
+		offset += 4
+		encUint32(b[offset:], uint32(len(picture.MIME)))
+		offset += 4
+		copy(b[offset:], picture.MIME)
+		offset += len(picture.MIME)
+		encUint32(b[offset:], uint32(len(picture.Desc)))
+		offset += 4
+		copy(b[offset:], picture.Desc)
+		offset += len(picture.Desc)
+		encUint32(b[offset:], picture.Width)
+		offset += 4
+		encUint32(b[offset:], picture.Height)
+		offset += 4
+		encUint32(b[offset:], picture.Depth)
+		offset += 4
+		encUint32(b[offset:], picture.NPalColors)
+		offset += 4
+		encUint32(b[offset:], uint32(len(picture.Data)))
+		offset += 4
+		copy(b[offset:], picture.Data)
+
+		buf.Write(b)
+	}
+
+}
+
+// setLastBlock sets the last-metadata-block flag of the last block in header.
+func setLastBlock(header []byte) {
+	pos := 4
+	for {
+		size := int(header[pos+1])<<16 | int(header[pos+2])<<8 | int(header[pos+3])
+		if pos+4+size >= len(header) {
+			header[pos] |= 1 << 7
+			return
+		}
+		pos += 4 + size
+	}
+}
+
+func pictureSize(picture *meta.Picture) int {
+	return 4 + 4 + len(picture.MIME) + 4 + len(picture.Desc) + 4*4 + 4 + len(picture.Data)
+}
+
+func encUint32(b []byte, n uint32) {
+	b[0] = byte(n >> 24 & 255)
+	b[1] = byte(n >> 16 & 255)
+	b[2] = byte(n >> 8 & 255)
+	b[3] = byte(n & 255)
+	return
+}
+
+func encUint64(b []byte, n uint64) {
+	encUint32(b[0:], uint32(n>>32))
+	encUint32(b[4:], uint32(n))
+	return
+}
+
+func cueSheetSize(cs *meta.CueSheet) (size int) {
+	size = 128 + 8 + 259 + 1
+	for _, track := range cs.Tracks {
+		size += 8 + 1 + 12 + 14 + 1 + 12*len(track.Indicies)
+	}
+	return
+}
+
+func encCueSheet(b []byte, cs *meta.CueSheet) {
+	offset := 0
+	copy(b[offset:offset+128], cs.MCN)
+	offset += 128
+	encUint64(b[offset:], cs.NLeadInSamples)
+	offset += 8
+	if cs.IsCompactDisc {
+		b[offset] = 1 << 7
+	}
+	offset += 259
+	b[offset] = byte(len(cs.Tracks))
+	offset++
+	for _, track := range cs.Tracks {
+		encUint64(b[offset:], track.Offset)
+		offset += 8
+		b[offset] = track.Num
+		offset++
+		copy(b[offset:offset+12], track.ISRC)
+		offset += 12
+		if !track.IsAudio {
+			b[offset] |= 1 << 7
+		}
+		if track.HasPreEmphasis {
+			b[offset] |= 1 << 6
+		}
+		offset += 14
+		b[offset] = byte(len(track.Indicies))
+		offset++
+		for _, index := range track.Indicies {
+			encUint64(b[offset:], index.Offset)
+			offset += 8
+			b[offset] = index.Num
+			offset += 4
+		}
+	}
+}
+
+func encUint32LE(b []byte, n uint32) {
+	b[0] = byte(n & 255)
+	b[1] = byte(n >> 8 & 255)
+	b[2] = byte(n >> 16 & 255)
+	b[3] = byte(n >> 24 & 255)
+	return
+}
+
+func vorbisCommentSize(comment *meta.VorbisComment) (size int) {
+	size = 4 + len(comment.Vendor) + 4
+	for _, tag := range comment.Tags {
+		size += 4 + len(tag[0]) + 1 + len(tag[1])
+	}
+	return
+}
+
+func encVorbisComment(b []byte, comment *meta.VorbisComment) {
+	offset := 0
+	encUint32LE(b[offset:], uint32(len(comment.Vendor)))
+	offset += 4
+	copy(b[offset:], comment.Vendor)
+	offset += len(comment.Vendor)
+	encUint32LE(b[offset:], uint32(len(comment.Tags)))
+	offset += 4
+	for _, tag := range comment.Tags {
+		encUint32LE(b[offset:], uint32(len(tag[0])+1+len(tag[1])))
+		offset += 4
+		copy(b[offset:], tag[0])
+		offset += len(tag[0])
+		b[offset] = '='
+		offset++
+		copy(b[offset:], tag[1])
+		offset += len(tag[1])
+	}
+}
@@ -0,0 +1,230 @@
+package merge
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TrackIssue is a missing or duplicated track number found by SortFiles.
+// Track 0 lists files without TRACKNUMBER among tagged ones.
+type TrackIssue struct {
+	Disc  int
+	Track int
+	// Paths are the files with the track number; empty if it is missing.
+	Paths []string
+}
+
+// Missing reports whether the track number is missing.
+func (ti TrackIssue) Missing() bool {
+	return len(ti.Paths) == 0
+}
+
+// Untagged reports whether the files have no track number.
+func (ti TrackIssue) Untagged() bool {
+	return ti.Track == 0
+}
+
+// SortFiles sorts files by DISCNUMBER, then by TRACKNUMBER, then by file name
+// in natural order ("2.flac" before "10.flac"). Numbers are accepted in form
+// "N" and "N/TOTAL". Pregap files, and files without TRACKNUMBER if others
+// have it, stay before the file following them. It returns the untagged
+// files, the duplicated track numbers and the missing ones between 1 and the
+// last track (or TOTAL) of each disc.
+func SortFiles(files []*FileInfo) []TrackIssue {
+	// units of files moved together
+	var issues []TrackIssue
+	attached := attachedFiles(files)
+	type unit struct {
+		key   *FileInfo
+		files []*FileInfo
+	}
+	var units []unit
+	var untagged, pending []*FileInfo
+	for i, info := range files {
+		pending = append(pending, info)
+		if !attached[i] {
+			units = append(units, unit{info, pending})
+			pending = nil
+		} else if !info.Pregap {
+			untagged = append(untagged, info)
+		}
+	}
+	if len(pending) > 0 {
+		if len(units) == 0 {
+			return nil
+		}
+		units[len(units)-1].files = append(units[len(units)-1].files, pending...)
+	}
+	if len(untagged) > 0 {
+		var issue TrackIssue
+		for _, info := range untagged {
+			issue.Paths = append(issue.Paths, info.Path)
+		}
+		issues = append(issues, issue)
+	}
+
+	sort.SliceStable(units, func(i, j int) bool {
+		a, b := units[i].key, units[j].key
+		if da, db := discNumber(a), discNumber(b); da != db {
+			return da < db
+		}
+		if ta, tb := trackNumber(a), trackNumber(b); ta != tb {
+			return ta < tb
+		}
+		return naturalLess(filepath.Base(a.Path), filepath.Base(b.Path))
+	})
+	files = files[:0]
+	for _, u := range units {
+		files = append(files, u.files...)
+	}
+
+	// check numbering
+	var keys []*FileInfo
+	for _, u := range units {
+		keys = append(keys, u.key)
+	}
+	for i := 0; i < len(keys); {
+		disc := discNumber(keys[i])
+		last, total := 0, 0
+		for ; i < len(keys) && discNumber(keys[i]) == disc; i++ {
+			track := trackNumber(keys[i])
+			if track == 0 {
+				continue
+			}
+			if track == last {
+				if n := len(issues) - 1; n >= 0 && !issues[n].Missing() && issues[n].Disc == disc && issues[n].Track == track {
+					issues[n].Paths = append(issues[n].Paths, keys[i].Path)
+				} else {
+					issues = append(issues, TrackIssue{disc, track, []string{keys[i-1].Path, keys[i].Path}})
+				}
+				continue
+			}
+			for n := last + 1; n < track; n++ {
+				issues = append(issues, TrackIssue{Disc: disc, Track: n})
+			}
+			last = track
+			if t := trackTotal(keys[i]); t > total {
+				total = t
+			}
+		}
+		if last > 0 {
+			for n := last + 1; n <= total; n++ {
+				issues = append(issues, TrackIssue{Disc: disc, Track: n})
+			}
+		}
+	}
+	return issues
+}
+
+// attachedFiles reports for files whether they belong to the file following
+// them: pregap files, and files without TRACKNUMBER if others have it.
+func attachedFiles(files []*FileInfo) []bool {
+	tagged := false
+	for _, info := range files {
+		if !info.Pregap && trackNumber(info) > 0 {
+			tagged = true
+		}
+	}
+	attached := make([]bool, len(files))
+	for i, info := range files {
+		attached[i] = info.Pregap || tagged && trackNumber(info) == 0
+	}
+	return attached
+}
+
+// SplitDiscs splits files ordered by SortFiles into discs by DISCNUMBER.
+// Files attached to the file following them go to its disc.
+func SplitDiscs(files []*FileInfo) [][]*FileInfo {
+	var discs [][]*FileInfo
+	attached := attachedFiles(files)
+	var pending []*FileInfo
+	var last *FileInfo
+	for i, info := range files {
+		pending = append(pending, info)
+		if attached[i] {
+			continue
+		}
+		if last == nil || discNumber(info) != discNumber(last) {
+			discs = append(discs, nil)
+		}
+		discs[len(discs)-1] = append(discs[len(discs)-1], pending...)
+		pending, last = nil, info
+	}
+	if len(pending) > 0 {
+		if len(discs) == 0 {
+			discs = append(discs, nil)
+		}
+		discs[len(discs)-1] = append(discs[len(discs)-1], pending...)
+	}
+	return discs
+}
+
+// discNumber returns the number of DISCNUMBER tag, or 0 if it is missing.
+func discNumber(info *FileInfo) int {
+	n, _ := splitNumber(info.Tag("DISCNUMBER"))
+	return n
+}
+
+// trackNumber returns the number of TRACKNUMBER tag, or 0 if it is missing.
+func trackNumber(info *FileInfo) int {
+	n, _ := splitNumber(info.Tag("TRACKNUMBER"))
+	return n
+}
+
+// trackTotal returns the number of tracks of the disc from TRACKNUMBER in
+// form "N/TOTAL" or from TRACKTOTAL (TOTALTRACKS) tag.
+func trackTotal(info *FileInfo) int {
+	_, total := splitNumber(info.Tag("TRACKNUMBER"))
+	if total == 0 {
+		total, _ = splitNumber(info.Tag("TRACKTOTAL"))
+	}
+	if total == 0 {
+		total, _ = splitNumber(info.Tag("TOTALTRACKS"))
+	}
+	return total
+}
+
+// splitNumber parses number in form "N" or "N/TOTAL". Invalid parts are 0.
+func splitNumber(s string) (n, total int) {
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		total, _ = strconv.Atoi(strings.TrimSpace(s[i+1:]))
+		s = s[:i]
+	}
+	n, _ = strconv.Atoi(strings.TrimSpace(s))
+	return n, total
+}
+
+// naturalLess compares strings with runs of digits compared by their value.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := digits(a), digits(b)
+		if da > 0 && db > 0 {
+			na := strings.TrimLeft(a[:da], "0")
+			nb := strings.TrimLeft(b[:db], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[da:], b[db:]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+// digits returns the length of the leading run of digits of s.
+func digits(s string) int {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return i
+}
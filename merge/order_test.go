@@ -0,0 +1,108 @@
+package merge
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNaturalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"2.flac", "10.flac", true},
+		{"10.flac", "2.flac", false},
+		{"track 02.flac", "track 2.flac", false},
+		{"a1b2", "a1b10", true},
+		{"a", "ab", true},
+		{"b", "a1", false},
+	}
+	for _, tt := range tests {
+		if got := naturalLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("naturalLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSortFiles(t *testing.T) {
+	file := func(path, disc, track string) *FileInfo {
+		return &FileInfo{Path: path, Tags: [][2]string{{"DISCNUMBER", disc}, {"tracknumber", track}}}
+	}
+	files := []*FileInfo{
+		file("10.flac", "2", "1/2"),
+		file("9.flac", "1", "4/5"),
+		file("b.flac", "1", "2"),
+		file("a.flac", "1", "2"),
+		file("1.flac", "1", "1"),
+		file("x.flac", "", ""),
+	}
+	issues := SortFiles(files)
+
+	var got []string
+	for _, info := range files {
+		got = append(got, info.Path)
+	}
+	want := []string{"1.flac", "x.flac", "a.flac", "b.flac", "9.flac", "10.flac"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got order %v, want %v", got, want)
+	}
+
+	wantIssues := []TrackIssue{
+		{Paths: []string{"x.flac"}},
+		{Disc: 1, Track: 2, Paths: []string{"a.flac", "b.flac"}},
+		{Disc: 1, Track: 3},
+		{Disc: 1, Track: 5},
+		{Disc: 2, Track: 2},
+	}
+	if !reflect.DeepEqual(issues, wantIssues) {
+		t.Errorf("got issues %+v, want %+v", issues, wantIssues)
+	}
+}
+
+func TestSortFilesPregap(t *testing.T) {
+	file := func(path, track string, pregap bool) *FileInfo {
+		return &FileInfo{Path: path, Tags: [][2]string{{"TRACKNUMBER", track}}, Pregap: pregap}
+	}
+	tests := []struct {
+		files []*FileInfo
+		want  []string
+	}{
+		// untagged pregap stays before its track
+		{
+			[]*FileInfo{file("02-gap.flac", "", true), file("02.flac", "2", false), file("01.flac", "1", false)},
+			[]string{"01.flac", "02-gap.flac", "02.flac"},
+		},
+		// tagged pregap is not a duplicate
+		{
+			[]*FileInfo{file("01.flac", "1", false), file("02-gap.flac", "2", true), file("02.flac", "2", false)},
+			[]string{"01.flac", "02-gap.flac", "02.flac"},
+		},
+		// untagged files only are ordered by name
+		{
+			[]*FileInfo{file("10.flac", "", false), file("02-gap.flac", "", true), file("02.flac", "", false), file("01.flac", "", false)},
+			[]string{"01.flac", "02-gap.flac", "02.flac", "10.flac"},
+		},
+	}
+	for _, tt := range tests {
+		issues := SortFiles(tt.files)
+		var got []string
+		for _, info := range tt.files {
+			got = append(got, info.Path)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("got order %v, want %v", got, tt.want)
+		}
+		if len(issues) > 0 {
+			t.Errorf("%v: got issues %+v", tt.want, issues)
+		}
+	}
+
+	discs := SplitDiscs([]*FileInfo{
+		{Path: "1.flac", Tags: [][2]string{{"DISCNUMBER", "1"}, {"TRACKNUMBER", "1"}}},
+		{Path: "gap.flac", Pregap: true},
+		{Path: "2.flac", Tags: [][2]string{{"DISCNUMBER", "2"}, {"TRACKNUMBER", "1"}}},
+	})
+	if len(discs) != 2 || len(discs[1]) != 2 || discs[1][0].Path != "gap.flac" {
+		t.Errorf("pregap not split with the disc following it: %v", discs)
+	}
+}
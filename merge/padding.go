@@ -0,0 +1,90 @@
+package merge
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mewkiz/flac/meta"
+)
+
+// Padding sets the PADDING block of the merged stream. The zero value rounds
+// the metadata up to a multiple of 256 bytes.
+type Padding struct {
+	// Size is the size of the padding in bytes. With Align it is the
+	// minimum size.
+	Size int
+	// Align rounds the size of the metadata up to a multiple of Align bytes.
+	Align int
+	// None writes no PADDING block.
+	None bool
+}
+
+// maxPadding is the maximum size of a metadata block.
+const maxPadding = 1<<24 - 1
+
+// ParsePadding parses a comma-separated list of padding specs: "N" for N
+// bytes of padding, "align:N" to round the metadata up to a multiple of N
+// bytes and "none" or "0" for no padding.
+func ParsePadding(spec string) (p Padding, err error) {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "none":
+			p.None = true
+		case strings.HasPrefix(item, "align:"):
+			p.Align, err = strconv.Atoi(strings.TrimPrefix(item, "align:"))
+			if err != nil || p.Align <= 0 || p.Align > maxPadding {
+				return p, fmt.Errorf("invalid padding alignment %q", item)
+			}
+		default:
+			p.Size, err = strconv.Atoi(item)
+			if err != nil || p.Size < 0 || p.Size > maxPadding {
+				return p, fmt.Errorf("invalid padding size %q", item)
+			}
+			if p.Size == 0 {
+				p.None = true
+			}
+		}
+	}
+	if p.None && (p.Size > 0 || p.Align > 0) {
+		return p, fmt.Errorf("padding %q: none can not be combined with size", spec)
+	}
+	if p.Size+p.Align > maxPadding {
+		return p, fmt.Errorf("padding %q: size and alignment exceed %d bytes", spec, maxPadding)
+	}
+	return p, nil
+}
+
+// writePadding writes the PADDING block as set by Options.Padding. Its size
+// is clamped to maxPadding.
+func (m *Merger) writePadding(buf *bytes.Buffer) {
+	opts := m.Options.Padding
+	if opts.None {
+		return
+	}
+	if opts.Size == 0 && opts.Align == 0 {
+		// round header up to 256 bytes
+		opts.Align = 256
+	}
+	padding := opts.Size
+	if opts.Align > 0 {
+		padding += opts.Align - (buf.Len()+4+padding)%opts.Align
+	}
+	if padding > maxPadding {
+		// the size of a block has 24 bits; keep alignment if possible
+		padding = maxPadding
+		if opts.Align > 0 && (buf.Len()+4+padding)%opts.Align <= padding {
+			padding -= (buf.Len() + 4 + padding) % opts.Align
+		}
+	}
+
+	// METADATA_BLOCK_HEADER: padding
+	b := make([]byte, 4+padding)
+	b[0] = byte(meta.TypePadding)
+	b[1] = byte(padding >> 16 & 255)
+	b[2] = byte(padding >> 8 & 255)
+	b[3] = byte(padding & 255)
+	buf.Write(b)
+}
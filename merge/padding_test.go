@@ -0,0 +1,92 @@
+package merge
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/mewkiz/flac/meta"
+	"github.com/sdidyk/flac2one/flac"
+)
+
+func TestParsePadding(t *testing.T) {
+	for spec, want := range map[string]Padding{
+		"8192":             {Size: 8192},
+		"align:4096":       {Align: 4096},
+		"1024, align:4096": {Size: 1024, Align: 4096},
+		"none":             {None: true},
+		"0":                {None: true},
+	} {
+		p, err := ParsePadding(spec)
+		if err != nil {
+			t.Errorf("%q: %v", spec, err)
+		} else if p != want {
+			t.Errorf("%q: expected %+v, got %+v", spec, want, p)
+		}
+	}
+	for _, spec := range []string{"", "-1", "align:0", "16777216", "none,100", "16777215,align:256"} {
+		if _, err := ParsePadding(spec); err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+}
+
+func TestPadding(t *testing.T) {
+	a := newTestStream("One", 10000, 4096, 0)
+	picture := &meta.Picture{Type: pictureFront, MIME: "image/png", Data: make([]byte, 1000)}
+	for _, test := range []struct {
+		opts    Options
+		types   []meta.Type
+		padding int64
+	}{
+		{Options{}, []meta.Type{meta.TypeSeekTable, meta.TypeVorbisComment, meta.TypePicture, meta.TypePadding}, -1},
+		{Options{Padding: Padding{Size: 8192}}, []meta.Type{meta.TypeSeekTable, meta.TypeVorbisComment, meta.TypePicture, meta.TypePadding}, 8192},
+		{Options{Padding: Padding{None: true}}, []meta.Type{meta.TypeSeekTable, meta.TypeVorbisComment, meta.TypePicture}, 0},
+		{Options{Padding: Padding{Align: 4096}, TagsFirst: true, CueSheet: true}, []meta.Type{meta.TypeVorbisComment, meta.TypeSeekTable, meta.TypeCueSheet, meta.TypePicture, meta.TypePadding}, -1},
+		{Options{Padding: Padding{Size: maxPadding, Align: 256}}, []meta.Type{meta.TypeSeekTable, meta.TypeVorbisComment, meta.TypePicture, meta.TypePadding}, -1},
+	} {
+		m := mergeTestStreams(t, test.opts, a)
+		m.Pictures = []*meta.Picture{picture}
+		var out bytes.Buffer
+		if _, err := m.WriteTo(&out); err != nil {
+			t.Fatal(err)
+		}
+		if int64(out.Len()) != m.Size() {
+			t.Errorf("%+v: size; expected %d, got %d", test.opts, m.Size(), out.Len())
+		}
+		stream, err := flac.Parse(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var types []meta.Type
+		for i, block := range stream.Blocks {
+			types = append(types, block.Type)
+			if block.IsLast != (i == len(stream.Blocks)-1) {
+				t.Errorf("%+v: block %d: unexpected last flag %v", test.opts, i, block.IsLast)
+			}
+		}
+		if !reflect.DeepEqual(types, test.types) {
+			t.Errorf("%+v: expected blocks %v, got %v", test.opts, test.types, types)
+		}
+		start, err := stream.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := stream.Blocks[len(stream.Blocks)-1]
+		switch {
+		case test.padding < 0:
+			align := int64(test.opts.Padding.Align)
+			if align == 0 {
+				align = 256
+			}
+			if start%align != 0 {
+				t.Errorf("%+v: audio starts at %d, not aligned to %d", test.opts, start, align)
+			}
+		case test.padding > 0 && last.Length != test.padding:
+			t.Errorf("%+v: expected %d bytes of padding, got %d", test.opts, test.padding, last.Length)
+		}
+		if err := Verify(bytes.NewReader(out.Bytes())); err != nil {
+			t.Errorf("%+v: %v", test.opts, err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package merge
+
+import (
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/sdidyk/flac2one/flac"
+)
+
+// pcmChunkSize is the size of sample chunks passed from scanning goroutines
+// to the MD5 hash.
+const pcmChunkSize = 1 << 16
+
+// pcmBufferChunks is the number of sample chunks which scans of later files
+// may decode ahead of the MD5 hash (128 MiB); tests lower it.
+var pcmBufferChunks = 128 << 20 / pcmChunkSize
+
+// scanned is called when the scan of path is done; tests replace it.
+var scanned = func(path string) {}
+
+// Input is a file added by AddFiles.
+type Input struct {
+	Path   string
+	Pregap bool
+}
+
+// scanJob is the scan of one input by a goroutine.
+type scanJob struct {
+	// ready is closed when stream or headErr is set
+	ready   chan struct{}
+	stream  *flac.Stream
+	headErr error
+	// head is closed when the samples of the job are hashed
+	head chan struct{}
+	// pcm passes the samples; it is closed when frames or scanErr is set
+	pcm     chan pcmChunk
+	frames  []scannedFrame
+	scanErr error
+}
+
+// pcmChunk is a chunk of samples; buffered is set if it takes a slot of the
+// buffer shared by all jobs.
+type pcmChunk struct {
+	data     []byte
+	buffered bool
+}
+
+// AddFiles appends the FLAC files of inputs like AddFile and AddPregapFile.
+// Files are decoded by Options.Workers goroutines in parallel while the
+// merged stream, including its MD5 sum, is the same as if they were added one
+// by one. Samples decoded ahead of the MD5 hash are kept in memory, at most
+// 128 MiB of them; then scans of later files wait.
+func (m *Merger) AddFiles(inputs []Input) error {
+	workers := m.Options.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers == 1 || m.Options.DryRun {
+		for _, in := range inputs {
+			err := m.addFile(in.Path, in.Pregap)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// start jobs in order, at most workers at once
+	stop := make(chan struct{})
+	buffer := make(chan struct{}, pcmBufferChunks)
+	jobs := make([]*scanJob, len(inputs))
+	for i := range jobs {
+		jobs[i] = &scanJob{
+			ready: make(chan struct{}),
+			head:  make(chan struct{}),
+			pcm:   make(chan pcmChunk, pcmBufferChunks),
+		}
+	}
+	var wg sync.WaitGroup
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sem := make(chan struct{}, workers)
+		for i, in := range inputs {
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				return
+			}
+			wg.Add(1)
+			go func(job *scanJob, path string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				job.scan(path, m.Options.Fast, buffer, stop)
+				scanned(path)
+			}(jobs[i], in.Path)
+		}
+	}()
+
+	// add results in order
+	for i, in := range inputs {
+		job := jobs[i]
+		<-job.ready
+		if job.headErr != nil {
+			return inputError(in.Path, job.headErr)
+		}
+		trackStart, pregap, err := m.addHeader(job.stream, in.Pregap)
+		if err != nil {
+			return inputError(in.Path, err)
+		}
+		close(job.head)
+		for chunk := range job.pcm {
+			m.md5sum.Write(chunk.data)
+			if chunk.buffered {
+				<-buffer
+			}
+		}
+		if job.scanErr != nil {
+			return inputError(in.Path, job.scanErr)
+		}
+		m.addFrames(&source{path: in.Path, info: job.stream.Info}, job.frames, trackStart, pregap)
+	}
+	return nil
+}
+
+// scan parses the file at path and decodes its frames until stop is closed.
+// With fast frames are found without decoding. Samples are passed to pcm
+// directly once the job is hashed, else they take slots of buffer.
+func (job *scanJob) scan(path string, fast bool, buffer chan struct{}, stop <-chan struct{}) {
+	defer close(job.pcm)
+	f, err := os.Open(path)
+	if err != nil {
+		job.headErr = err
+		close(job.ready)
+		return
+	}
+	defer f.Close()
+	stream, err := flac.Parse(f)
+	if err != nil {
+		job.headErr = err
+		close(job.ready)
+		return
+	}
+	job.stream = stream
+	close(job.ready)
+
+	if fast {
+		job.frames, job.scanErr = scanStreamFast(stream, f, stop)
+		return
+	}
+
+	w := &pcmWriter{ch: job.pcm, head: job.head, buffer: buffer, stop: stop}
+	job.frames, job.scanErr = scanFrames(stream, w, stop)
+	w.flush()
+}
+
+// pcmWriter is a hash.Hash passing the written samples to ch in chunks.
+type pcmWriter struct {
+	buf    []byte
+	ch     chan<- pcmChunk
+	head   <-chan struct{}
+	buffer chan<- struct{}
+	stop   <-chan struct{}
+}
+
+func (w *pcmWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= pcmChunkSize {
+		w.flush()
+	}
+	return len(p), nil
+}
+
+// flush passes the buffered samples to ch unless stop is closed. Until head
+// is closed it waits for a free slot of buffer.
+func (w *pcmWriter) flush() {
+	if len(w.buf) == 0 {
+		return
+	}
+	chunk := pcmChunk{data: w.buf}
+	select {
+	case w.buffer <- struct{}{}:
+		chunk.buffered = true
+	case <-w.head:
+	case <-w.stop:
+		return
+	}
+	select {
+	case w.ch <- chunk:
+	case <-w.stop:
+	}
+	w.buf = make([]byte, 0, pcmChunkSize)
+}
+
+func (w *pcmWriter) Sum(b []byte) []byte { return b }
+func (w *pcmWriter) Reset()              { w.buf = w.buf[:0] }
+func (w *pcmWriter) Size() int           { return 0 }
+func (w *pcmWriter) BlockSize() int      { return 1 }
@@ -0,0 +1,124 @@
+package merge
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddFiles(t *testing.T) {
+	dir := t.TempDir()
+	var inputs []Input
+	var pcm []byte
+	for i := 0; i < 8; i++ {
+		ts := newTestStream(fmt.Sprint("Track ", i), 20000+i*1000, 1152, int16(i*100))
+		path := filepath.Join(dir, fmt.Sprintf("%02d.flac", i))
+		if err := ioutil.WriteFile(path, ts.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, Input{Path: path})
+		pcm = append(pcm, ts.pcm...)
+	}
+
+	var outs [][]byte
+	for _, workers := range []int{1, 3} {
+		m := New(Options{Workers: workers})
+		if err := m.AddFiles(inputs); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if _, err := m.WriteTo(&out); err != nil {
+			t.Fatal(err)
+		}
+		checkStream(t, out.Bytes(), pcm)
+		outs = append(outs, out.Bytes())
+	}
+	if !bytes.Equal(outs[0], outs[1]) {
+		t.Error("parallel result differs from sequential one")
+	}
+
+	// errors are reported for the file in order
+	inputs[2].Path = filepath.Join(dir, "missing.flac")
+	m := New(Options{Workers: 3})
+	err := m.AddFiles(inputs)
+	var parseErr *InputParseError
+	if !errors.As(err, &parseErr) || parseErr.Path != inputs[2].Path || !strings.Contains(err.Error(), "missing.flac") {
+		t.Errorf("expected error for missing file, got %v", err)
+	}
+}
+
+// blockingHash is a hash.Hash whose writes wait until release is closed.
+type blockingHash struct {
+	hash.Hash
+	release <-chan struct{}
+}
+
+func (h *blockingHash) Write(p []byte) (int, error) {
+	<-h.release
+	return h.Hash.Write(p)
+}
+
+func TestAddFilesParallel(t *testing.T) {
+	dir := t.TempDir()
+	var inputs []Input
+	var pcm []byte
+	for i := 0; i < 4; i++ {
+		// about 13 chunks of samples
+		ts := newTestStream(fmt.Sprint("Track ", i), 200000, 4096, int16(i*100))
+		path := filepath.Join(dir, fmt.Sprintf("%02d.flac", i))
+		if err := ioutil.WriteFile(path, ts.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, Input{Path: path})
+		pcm = append(pcm, ts.pcm...)
+	}
+	defer func(n int) { pcmBufferChunks = n }(pcmBufferChunks)
+	defer func() { scanned = func(string) {} }()
+
+	for _, test := range []struct {
+		chunks int
+		// scans done while the samples of the first file are not hashed
+		scans int
+	}{
+		{64, len(inputs)},
+		{8, 0},
+	} {
+		pcmBufferChunks = test.chunks
+		done := make(chan string, len(inputs))
+		scanned = func(path string) { done <- path }
+		release := make(chan struct{})
+		go func() {
+			defer close(release)
+			for i := 0; i < test.scans; i++ {
+				select {
+				case <-done:
+				case <-time.After(10 * time.Second):
+					t.Errorf("buffer of %d chunks: scans wait for the hashing of earlier files", test.chunks)
+					return
+				}
+			}
+			select {
+			case <-done:
+				t.Errorf("buffer of %d chunks: more than %d scans done ahead of hashing", test.chunks, test.scans)
+			case <-time.After(200 * time.Millisecond):
+			}
+		}()
+
+		m := New(Options{Workers: 2})
+		m.md5sum = &blockingHash{Hash: m.md5sum, release: release}
+		if err := m.AddFiles(inputs); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if _, err := m.WriteTo(&out); err != nil {
+			t.Fatal(err)
+		}
+		checkStream(t, out.Bytes(), pcm)
+	}
+}
@@ -0,0 +1,216 @@
+package merge
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"mime"
+
+	"github.com/mewkiz/flac/meta"
+)
+
+// PictureMode selects the PICTURE blocks taken from added streams.
+type PictureMode int
+
+const (
+	// PictureFront keeps the first front cover of the first stream.
+	PictureFront PictureMode = iota
+	// PictureFirst keeps all pictures of the first stream.
+	PictureFirst
+	// PictureAll keeps the pictures of all streams; identical pictures are
+	// kept once.
+	PictureAll
+	// PictureLargest keeps the front cover of all streams with the most
+	// pixels. The size is read from the image data if the PICTURE block has
+	// none.
+	PictureLargest
+)
+
+// pictureFront is the picture type of front covers.
+const pictureFront = 3
+
+// addPicture takes pic of an added stream according to Options.Pictures.
+// First is set for the first stream.
+func (m *Merger) addPicture(pic *meta.Picture, first bool) {
+	switch m.Options.Pictures {
+	case PictureFront:
+		if first && len(m.Pictures) == 0 && pic.Type == pictureFront {
+			m.Pictures = append(m.Pictures, pic)
+		}
+	case PictureFirst:
+		if first {
+			m.Pictures = append(m.Pictures, pic)
+		}
+	case PictureAll:
+		sum := md5.Sum(pic.Data)
+		for _, v := range m.Pictures {
+			if md5.Sum(v.Data) == sum {
+				return
+			}
+		}
+		m.Pictures = append(m.Pictures, pic)
+	case PictureLargest:
+		if pic.Type != pictureFront {
+			return
+		}
+		if len(m.Pictures) == 0 {
+			m.Pictures = append(m.Pictures, pic)
+		} else if pictureArea(pic) > pictureArea(m.Pictures[0]) {
+			m.Pictures[0] = pic
+		}
+	}
+}
+
+// pictureArea returns the number of pixels of pic. If the PICTURE block has
+// no size, it is read from the image data.
+func pictureArea(pic *meta.Picture) uint64 {
+	w, h := pic.Width, pic.Height
+	if w == 0 || h == 0 {
+		header := &meta.Picture{Data: pic.Data}
+		if parseImageHeader(header) == nil {
+			w, h = header.Width, header.Height
+		}
+	}
+	return uint64(w) * uint64(h)
+}
+
+// PictureExt returns the file name extension for the MIME type of pic.
+func PictureExt(pic *meta.Picture) string {
+	switch pic.MIME {
+	case "image/jpeg", "image/jpg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/bmp":
+		return ".bmp"
+	case "image/webp":
+		return ".webp"
+	case "image/tiff":
+		return ".tif"
+	}
+	if exts, _ := mime.ExtensionsByType(pic.MIME); len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// FrontCover returns the first front cover of the merged stream, or its
+// first picture if there is no front cover, or nil.
+func (m *Merger) FrontCover() *meta.Picture {
+	for _, pic := range m.Pictures {
+		if pic.Type == pictureFront && pic.MIME != "-->" {
+			return pic
+		}
+	}
+	for _, pic := range m.Pictures {
+		if pic.MIME != "-->" {
+			return pic
+		}
+	}
+	return nil
+}
+
+// SetFrontCover replaces the front covers of the merged stream with pic.
+func (m *Merger) SetFrontCover(pic *meta.Picture) {
+	pictures := []*meta.Picture{pic}
+	for _, v := range m.Pictures {
+		if v.Type != pictureFront {
+			pictures = append(pictures, v)
+		}
+	}
+	m.Pictures = pictures
+}
+
+// ReadPictureFile reads a JPEG, PNG or GIF image as a front cover. MIME
+// type, width, height, color depth and number of palette colors are taken
+// from the image header.
+func ReadPictureFile(path string) (*meta.Picture, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pic := &meta.Picture{Type: pictureFront, Data: data}
+	err = parseImageHeader(pic)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return pic, nil
+}
+
+// parseImageHeader sets MIME and dimensions of pic from its data like
+// metaflac does.
+func parseImageHeader(pic *meta.Picture) error {
+	b := pic.Data
+	switch {
+	// PNG: IHDR chunk follows the signature
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		if len(b) < 8+8+13 || string(b[12:16]) != "IHDR" {
+			return fmt.Errorf("invalid PNG header")
+		}
+		pic.MIME = "image/png"
+		pic.Width = decUint32(b[16:])
+		pic.Height = decUint32(b[20:])
+		bitDepth, colorType := uint32(b[24]), b[25]
+		switch colorType {
+		case 0: // gray
+			pic.Depth = bitDepth
+		case 2: // RGB
+			pic.Depth = bitDepth * 3
+		case 3: // palette of 8 bit RGB entries
+			pic.Depth = 8 * 3
+			pic.NPalColors = 1 << bitDepth
+		case 4: // gray and alpha
+			pic.Depth = bitDepth * 2
+		case 6: // RGBA
+			pic.Depth = bitDepth * 4
+		}
+		return nil
+
+	// GIF: logical screen descriptor follows the signature
+	case bytes.HasPrefix(b, []byte("GIF87a")) || bytes.HasPrefix(b, []byte("GIF89a")):
+		if len(b) < 13 {
+			return fmt.Errorf("invalid GIF header")
+		}
+		pic.MIME = "image/gif"
+		pic.Width = uint32(b[6]) | uint32(b[7])<<8
+		pic.Height = uint32(b[8]) | uint32(b[9])<<8
+		pic.Depth = 8 * 3
+		pic.NPalColors = 1 << (b[10]&7 + 1)
+		return nil
+
+	// JPEG: dimensions are in the first SOFn segment
+	case bytes.HasPrefix(b, []byte{0xFF, 0xD8}):
+		pic.MIME = "image/jpeg"
+		for pos := 2; pos+4 <= len(b); {
+			if b[pos] != 0xFF {
+				return fmt.Errorf("invalid JPEG segment at offset %d", pos)
+			}
+			marker := b[pos+1]
+			if marker == 0xFF {
+				// fill byte
+				pos++
+				continue
+			}
+			size := int(b[pos+2])<<8 | int(b[pos+3])
+			if marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC {
+				if pos+10 > len(b) {
+					break
+				}
+				pic.Height = uint32(b[pos+5])<<8 | uint32(b[pos+6])
+				pic.Width = uint32(b[pos+7])<<8 | uint32(b[pos+8])
+				pic.Depth = uint32(b[pos+4]) * uint32(b[pos+9])
+				return nil
+			}
+			pos += 2 + size
+		}
+		return fmt.Errorf("no JPEG frame header")
+	}
+	return fmt.Errorf("unknown image format")
+}
+
+func decUint32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
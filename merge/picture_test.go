@@ -0,0 +1,114 @@
+package merge
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/mewkiz/flac/meta"
+)
+
+func TestParseImageHeader(t *testing.T) {
+	rgba := image.NewNRGBA(image.Rect(0, 0, 300, 200))
+	var pngData, jpegData, gifData bytes.Buffer
+	if err := png.Encode(&pngData, rgba); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&jpegData, rgba, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.Encode(&gifData, image.NewPaletted(image.Rect(0, 0, 300, 200), palette.Plan9), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		data       []byte
+		mime       string
+		depth, pal uint32
+	}{
+		{pngData.Bytes(), "image/png", 32, 0},
+		{jpegData.Bytes(), "image/jpeg", 24, 0},
+		{gifData.Bytes(), "image/gif", 24, 256},
+	} {
+		pic := &meta.Picture{Data: test.data}
+		if err := parseImageHeader(pic); err != nil {
+			t.Errorf("%s: %v", test.mime, err)
+			continue
+		}
+		if pic.MIME != test.mime || pic.Width != 300 || pic.Height != 200 || pic.Depth != test.depth || pic.NPalColors != test.pal {
+			t.Errorf("%s: unexpected %s %dx%d depth %d colors %d", test.mime, pic.MIME, pic.Width, pic.Height, pic.Depth, pic.NPalColors)
+		}
+	}
+	if err := parseImageHeader(&meta.Picture{Data: []byte("BM")}); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestAddPicture(t *testing.T) {
+	front := &meta.Picture{Type: pictureFront, Width: 500, Height: 500, Data: []byte("front")}
+	back := &meta.Picture{Type: 4, Width: 500, Height: 500, Data: []byte("back")}
+	large := &meta.Picture{Type: pictureFront, Width: 1000, Height: 1000, Data: []byte("large")}
+	same := &meta.Picture{Type: pictureFront, Width: 500, Height: 500, Data: []byte("front")}
+	for _, test := range []struct {
+		mode PictureMode
+		want []*meta.Picture
+	}{
+		{PictureFront, []*meta.Picture{front}},
+		{PictureFirst, []*meta.Picture{back, front}},
+		{PictureAll, []*meta.Picture{back, front, large}},
+		{PictureLargest, []*meta.Picture{large}},
+	} {
+		m := New(Options{Pictures: test.mode})
+		m.addPicture(back, true)
+		m.addPicture(front, true)
+		m.addPicture(same, false)
+		m.addPicture(large, false)
+		if len(m.Pictures) != len(test.want) {
+			t.Errorf("mode %d: expected %d pictures, got %d", test.mode, len(test.want), len(m.Pictures))
+			continue
+		}
+		for i, pic := range test.want {
+			if m.Pictures[i] != pic {
+				t.Errorf("mode %d: picture %d is %s, expected %s", test.mode, i, m.Pictures[i].Data, pic.Data)
+			}
+		}
+	}
+
+	// size is read from the image data if the PICTURE block has none
+	var small, big bytes.Buffer
+	if err := png.Encode(&small, image.NewNRGBA(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&big, image.NewNRGBA(image.Rect(0, 0, 20, 20))); err != nil {
+		t.Fatal(err)
+	}
+	first := &meta.Picture{Type: pictureFront, MIME: "image/png", Data: small.Bytes()}
+	second := &meta.Picture{Type: pictureFront, MIME: "image/png", Data: big.Bytes()}
+	m := New(Options{Pictures: PictureLargest})
+	m.addPicture(first, true)
+	m.addPicture(second, false)
+	if len(m.Pictures) != 1 || m.Pictures[0] != second || second.Width != 0 {
+		t.Error("expected larger picture without size in PICTURE block")
+	}
+}
+
+func TestFrontCover(t *testing.T) {
+	link := &meta.Picture{Type: pictureFront, MIME: "-->", Data: []byte("http://example.com/cover.jpg")}
+	back := &meta.Picture{Type: 4, MIME: "image/png"}
+	front := &meta.Picture{Type: pictureFront, MIME: "image/jpeg"}
+	m := New(Options{})
+	if m.FrontCover() != nil {
+		t.Error("expected no cover")
+	}
+	m.Pictures = []*meta.Picture{link, back}
+	if m.FrontCover() != back {
+		t.Error("expected first picture without front cover")
+	}
+	m.Pictures = append(m.Pictures, front)
+	if m.FrontCover() != front || PictureExt(m.FrontCover()) != ".jpg" {
+		t.Error("expected front cover")
+	}
+}
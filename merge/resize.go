@@ -0,0 +1,123 @@
+package merge
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	_ "image/gif" // decode GIF pictures
+	"image/jpeg"
+	_ "image/png" // decode PNG pictures
+
+	"github.com/mewkiz/flac/meta"
+)
+
+// ResizePictures downscales the pictures of m which are larger than maxSize
+// pixels in width or height (0 for no limit) and re-encodes them as JPEG of
+// the given quality. A JPEG picture which needs no downscaling is kept if
+// re-encoding does not make it smaller. It returns the original pictures
+// which are replaced and the pictures which are kept unchanged because they
+// can not be decoded (e.g. WebP or BMP).
+func (m *Merger) ResizePictures(maxSize, quality int) (replaced, skipped []*meta.Picture, err error) {
+	for i, pic := range m.Pictures {
+		if pic.MIME == "-->" {
+			// link to a picture
+			continue
+		}
+		src, _, err := image.Decode(bytes.NewReader(pic.Data))
+		if err != nil {
+			skipped = append(skipped, pic)
+			continue
+		}
+		resized, err := resizePicture(pic, src, maxSize, quality)
+		if err != nil {
+			return replaced, skipped, err
+		}
+		if resized != pic {
+			m.Pictures[i] = resized
+			replaced = append(replaced, pic)
+		}
+	}
+	return replaced, skipped, nil
+}
+
+// resizePicture returns pic with the decoded image src downscaled to maxSize
+// and encoded as JPEG, or pic itself if it is kept.
+func resizePicture(pic *meta.Picture, src image.Image, maxSize, quality int) (*meta.Picture, error) {
+	// new size keeping aspect ratio
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	scaled := maxSize > 0 && (w > maxSize || h > maxSize)
+	if scaled {
+		if w >= h {
+			w, h = maxSize, (h*maxSize+w/2)/w
+		} else {
+			w, h = (w*maxSize+h/2)/h, maxSize
+		}
+		if w < 1 {
+			w = 1
+		}
+		if h < 1 {
+			h = 1
+		}
+	}
+
+	// flatten transparency onto white, then scale
+	rgba := image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min, draw.Over)
+	if scaled {
+		rgba = downscale(rgba, w, h)
+	}
+
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, rgba, &jpeg.Options{Quality: quality})
+	if err != nil {
+		return nil, err
+	}
+	if !scaled && pic.MIME == "image/jpeg" && buf.Len() >= len(pic.Data) {
+		return pic, nil
+	}
+	return &meta.Picture{
+		Type:   pic.Type,
+		MIME:   "image/jpeg",
+		Desc:   pic.Desc,
+		Width:  uint32(w),
+		Height: uint32(h),
+		Depth:  24,
+		Data:   buf.Bytes(),
+	}, nil
+}
+
+// downscale returns src scaled to w×h pixels; every pixel is the average of
+// the source area it covers.
+func downscale(src *image.RGBA, w, h int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 == x0 {
+				x1++
+			}
+			var sum [4]uint64
+			for sy := y0; sy < y1; sy++ {
+				p := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(p); i += 4 {
+					sum[0] += uint64(p[i])
+					sum[1] += uint64(p[i+1])
+					sum[2] += uint64(p[i+2])
+					sum[3] += uint64(p[i+3])
+				}
+			}
+			n := uint64((y1 - y0) * (x1 - x0))
+			d := dst.Pix[y*dst.Stride+x*4:]
+			for i := range sum {
+				d[i] = uint8((sum[i] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,63 @@
+package merge
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/mewkiz/flac/meta"
+)
+
+func TestResizePictures(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	var pngData, jpegData bytes.Buffer
+	if err := png.Encode(&pngData, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&jpegData, img, &jpeg.Options{Quality: 50}); err != nil {
+		t.Fatal(err)
+	}
+	cover := &meta.Picture{Type: pictureFront, MIME: "image/png", Desc: "cover", Data: pngData.Bytes()}
+	back := &meta.Picture{Type: 4, MIME: "image/jpeg", Data: jpegData.Bytes()}
+
+	bmp := &meta.Picture{Type: 4, MIME: "image/bmp", Data: []byte("BM")}
+
+	m := New(Options{})
+	m.Pictures = []*meta.Picture{cover, bmp, back}
+	replaced, skipped, err := m.ResizePictures(100, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replaced) != 2 || replaced[0] != cover || replaced[1] != back {
+		t.Fatalf("expected both pictures replaced, got %d", len(replaced))
+	}
+	if len(skipped) != 1 || skipped[0] != bmp || m.Pictures[1] != bmp {
+		t.Errorf("expected BMP picture kept unchanged, got %d skipped", len(skipped))
+	}
+	pic := m.Pictures[0]
+	if pic.Type != pictureFront || pic.Desc != "cover" || pic.MIME != "image/jpeg" || pic.Width != 100 || pic.Height != 50 || pic.Depth != 24 {
+		t.Errorf("unexpected picture %d %q %s %dx%dx%d", pic.Type, pic.Desc, pic.MIME, pic.Width, pic.Height, pic.Depth)
+	}
+	header := &meta.Picture{Data: pic.Data}
+	if err := parseImageHeader(header); err != nil || header.Width != 100 || header.Height != 50 {
+		t.Errorf("unexpected JPEG data %dx%d: %v", header.Width, header.Height, err)
+	}
+
+	// a JPEG within the limit is kept unless re-encoding makes it smaller
+	m.Pictures = []*meta.Picture{back}
+	replaced, _, err = m.ResizePictures(0, 95)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replaced) != 0 || m.Pictures[0] != back {
+		t.Error("expected JPEG picture kept")
+	}
+}
@@ -0,0 +1,182 @@
+package merge
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mewkiz/flac/meta"
+)
+
+// SeekTable sets the seek points of the merged stream like the
+// --add-seekpoint option of metaflac. Points of all set fields are combined;
+// the zero value sets a point at the start of each track and about every 10
+// seconds of it.
+type SeekTable struct {
+	// Seconds is the interval between points within each track. Points are
+	// set at track starts too.
+	Seconds float64
+	// Samples are points at these samples of the stream.
+	Samples []uint64
+	// Count points are spread evenly over the whole stream.
+	Count int
+	// TrackStarts sets points at the start (INDEX 00 and 01) of each track.
+	TrackStarts bool
+	// None disables all points but placeholders; without them no SEEKTABLE
+	// block is written.
+	None bool
+	// Placeholders is the number of placeholder points appended.
+	Placeholders int
+}
+
+// ParseSeekTable parses a comma-separated list of seek point specs in the
+// syntax of metaflac --add-seekpoint: "N" for a point at sample N, "Ns" for a
+// point every N seconds (of each track), "Nx" for N points spread over the
+// stream and "X" for a placeholder point. In addition "tracks" sets points at
+// track starts only and "none" sets no points.
+func ParseSeekTable(spec string) (st SeekTable, err error) {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "none":
+			st.None = true
+		case item == "tracks":
+			st.TrackStarts = true
+		case item == "X":
+			st.Placeholders++
+		case strings.HasSuffix(item, "s"):
+			if st.Seconds != 0 {
+				return st, fmt.Errorf("repeated seek point interval %q", item)
+			}
+			st.Seconds, err = strconv.ParseFloat(strings.TrimSuffix(item, "s"), 64)
+			if err != nil || st.Seconds <= 0 {
+				return st, fmt.Errorf("invalid seek point interval %q", item)
+			}
+		case strings.HasSuffix(item, "x"):
+			if st.Count != 0 {
+				return st, fmt.Errorf("repeated number of seek points %q", item)
+			}
+			st.Count, err = strconv.Atoi(strings.TrimSuffix(item, "x"))
+			if err != nil || st.Count <= 0 {
+				return st, fmt.Errorf("invalid number of seek points %q", item)
+			}
+		default:
+			n, err := strconv.ParseUint(item, 10, 64)
+			if err != nil {
+				return st, fmt.Errorf("invalid seek point spec %q", item)
+			}
+			st.Samples = append(st.Samples, n)
+		}
+	}
+	return st, nil
+}
+
+// seekPoints returns the seek points of the merged stream. Every point is
+// set at the frame holding its target sample; duplicates are dropped.
+func (m *Merger) seekPoints() []meta.SeekPoint {
+	opts := m.Options.SeekTable
+
+	// track starts
+	var starts []uint64
+	for _, v := range m.Tracks {
+		if v.Pregap > 0 {
+			starts = append(starts, v.Offset-v.Pregap)
+		}
+		starts = append(starts, v.Offset)
+	}
+
+	// target samples
+	var targets []uint64
+	if !opts.None {
+		interval := uint64(opts.Seconds * float64(m.SampleRate))
+		if interval == 0 && len(opts.Samples) == 0 && opts.Count == 0 && !opts.TrackStarts {
+			interval = 10 * uint64(m.SampleRate)
+		}
+
+		if interval > 0 || opts.TrackStarts {
+			targets = append(targets, starts...)
+		}
+
+		// points within each track
+		if interval > 0 {
+			for i, start := range starts {
+				end := m.totalSamples
+				if i+1 < len(starts) {
+					end = starts[i+1]
+				}
+				for n := start + interval; n < end; n += interval {
+					targets = append(targets, n)
+				}
+			}
+		}
+
+		// points at samples and spread over the stream
+		targets = append(targets, opts.Samples...)
+		for i := 0; i < opts.Count; i++ {
+			targets = append(targets, m.totalSamples*uint64(i)/uint64(opts.Count))
+		}
+		sort.Slice(targets, func(i, j int) bool { return targets[i] < targets[j] })
+	}
+
+	// find frames
+	var points []meta.SeekPoint
+	if m.Options.DryRun {
+		points = m.estimateSeekPoints(targets, starts)
+	}
+	offset := uint64(0)
+	for _, src := range m.sources {
+		for i, fr := range src.frames {
+			end := m.totalSamples
+			if i+1 < len(src.frames) {
+				end = src.frames[i+1].sampleNum
+			} else if src.samples > 0 {
+				end = src.start + src.samples
+			}
+			if len(targets) > 0 && targets[0] < end {
+				points = append(points, meta.SeekPoint{
+					SampleNum: fr.sampleNum,
+					Offset:    offset,
+					NSamples:  uint16(end - fr.sampleNum),
+				})
+			}
+			for len(targets) > 0 && targets[0] < end {
+				targets = targets[1:]
+			}
+			offset += uint64(fr.size) - uint64(getUtf8Size(fr.num)) + uint64(getUtf8Size(m.codedNum(fr)))
+		}
+	}
+
+	// placeholders
+	for i := 0; i < opts.Placeholders; i++ {
+		points = append(points, meta.SeekPoint{SampleNum: placeholder})
+	}
+	return points
+}
+
+// estimateSeekPoints returns the seek points of a dry run, where no frames
+// are scanned. Streams starting at starts are assumed to have fixed block
+// size blockSizeMax; the offsets of the points are unknown.
+func (m *Merger) estimateSeekPoints(targets, starts []uint64) []meta.SeekPoint {
+	blockSize := uint64(m.blockSizeMax)
+	if blockSize == 0 {
+		blockSize = 4096
+	}
+	var points []meta.SeekPoint
+	for _, n := range targets {
+		if n >= m.totalSamples {
+			break
+		}
+		start := uint64(0)
+		for _, v := range starts {
+			if v <= n {
+				start = v
+			}
+		}
+		n -= (n - start) % blockSize
+		if len(points) == 0 || points[len(points)-1].SampleNum != n {
+			points = append(points, meta.SeekPoint{SampleNum: n, NSamples: uint16(blockSize)})
+		}
+	}
+	return points
+}
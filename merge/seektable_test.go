@@ -0,0 +1,94 @@
+package merge
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/mewkiz/flac/meta"
+	"github.com/sdidyk/flac2one/flac"
+)
+
+func TestParseSeekTable(t *testing.T) {
+	st, err := ParseSeekTable("5s, 100x,tracks,X,X,44100,0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SeekTable{Seconds: 5, Samples: []uint64{44100, 0}, Count: 100, TrackStarts: true, Placeholders: 2}
+	if !reflect.DeepEqual(st, want) {
+		t.Errorf("expected %+v, got %+v", want, st)
+	}
+	for _, spec := range []string{"", "0s", "-1x", "abc", "10 s", "#", "5s,10s", "2x,3x"} {
+		if _, err := ParseSeekTable(spec); err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+}
+
+func TestSeekPoints(t *testing.T) {
+	a := newTestStream("One", 20000, 1000, 0)
+	b := newTestStream("Two", 10000, 1000, 100)
+	for _, test := range []struct {
+		st   SeekTable
+		want []uint64
+	}{
+		{SeekTable{}, []uint64{0, 20000}},
+		{SeekTable{Samples: []uint64{4500, 21000, 40000}}, []uint64{4000, 21000}},
+		{SeekTable{Seconds: 0.25, Samples: []uint64{4500}}, []uint64{0, 4000, 11000, 20000}},
+		{SeekTable{Count: 3}, []uint64{0, 10000, 20000}},
+		{SeekTable{TrackStarts: true}, []uint64{0, 20000}},
+		{SeekTable{TrackStarts: true, Placeholders: 1}, []uint64{0, 20000, placeholder}},
+		{SeekTable{None: true, Placeholders: 2}, []uint64{placeholder, placeholder}},
+		{SeekTable{None: true}, nil},
+	} {
+		var out bytes.Buffer
+		m := mergeTestStreams(t, Options{SeekTable: test.st}, a, b)
+		if _, err := m.WriteTo(&out); err != nil {
+			t.Fatal(err)
+		}
+		if err := Verify(bytes.NewReader(out.Bytes())); err != nil {
+			t.Errorf("%+v: %v", test.st, err)
+		}
+		stream, err := flac.Parse(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []uint64
+		for _, block := range stream.Blocks {
+			if body, ok := block.Body.(*meta.SeekTable); ok {
+				for _, point := range body.Points {
+					got = append(got, point.SampleNum)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v: expected points %v, got %v", test.st, test.want, got)
+		}
+	}
+}
+
+func TestSeekPointsDryRun(t *testing.T) {
+	a := newTestStream("One", 20000, 1000, 0)
+	b := newTestStream("Two", 10000, 1000, 100)
+	for _, st := range []SeekTable{{}, {Seconds: 0.1}, {Count: 7}, {Samples: []uint64{4500, 21000}, Placeholders: 1}, {None: true}} {
+		m := mergeTestStreams(t, Options{SeekTable: st}, a, b)
+		var out bytes.Buffer
+		if _, err := m.WriteTo(&out); err != nil {
+			t.Fatal(err)
+		}
+		dry := mergeTestStreams(t, Options{SeekTable: st, DryRun: true}, a, b)
+		if dry.Size() != int64(out.Len()) {
+			t.Errorf("%+v: estimated size %d, got %d", st, dry.Size(), out.Len())
+		}
+		want, got := m.seekPoints(), dry.seekPoints()
+		if len(got) != len(want) {
+			t.Errorf("%+v: estimated %d points, got %d", st, len(got), len(want))
+			continue
+		}
+		for i := range want {
+			if got[i].SampleNum != want[i].SampleNum {
+				t.Errorf("%+v: point %d; estimated sample %d, got %d", st, i, got[i].SampleNum, want[i].SampleNum)
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package merge
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/mewkiz/flac/meta"
+	"github.com/sdidyk/flac2one/flac"
+)
+
+// Split cuts the FLAC image r into the tracks of cue without re-encoding.
+// Tracks are cut on frame boundaries; a frame belongs to the track in which
+// the larger part of its samples lies. For every track fn is called with a
+// Merger holding its tags and frame positions in r; the Merger can be written
+// only during the call. Errors of reading r are InputParseError.
+func Split(r io.ReadSeeker, cue *CueSheet, opts Options, fn func(track CueTrack, m *Merger) error) error {
+	stream, err := flac.Parse(r)
+	if err != nil {
+		return &InputParseError{Frame: -1, Err: err}
+	}
+
+	// get meta
+	album := &Merger{Options: opts, Album: cue.Title, Artist: cue.Performer, Date: cue.Date, Genre: cue.Genre}
+	for _, block := range stream.Blocks {
+		switch body := block.Body.(type) {
+		// tags: use as fallback for CUE-sheet
+		case *meta.VorbisComment:
+			for _, tag := range body.Tags {
+				switch strings.ToUpper(tag[0]) {
+				case "ALBUM":
+					if album.Album == "" {
+						album.Album = tag[1]
+					}
+				case "ARTIST":
+					if album.Artist == "" {
+						album.Artist = tag[1]
+					}
+				case "DATE":
+					if album.Date == "" {
+						album.Date = tag[1]
+					}
+				case "GENRE":
+					if album.Genre == "" {
+						album.Genre = tag[1]
+					}
+				}
+			}
+
+		case *meta.Picture:
+			album.addPicture(body, true)
+		}
+	}
+
+	// get start offset
+	start, err := stream.Pos()
+	if err != nil {
+		return err
+	}
+
+	var m *Merger
+	track := -1
+	flush := func() error {
+		defer m.Close()
+		if m.totalFrames == 0 {
+			return fmt.Errorf("track %02d is shorter than one frame", cue.Tracks[track].Num)
+		}
+		m.sources[0].samples = m.totalSamples
+		return fn(cue.Tracks[track], m)
+	}
+
+	// scan frames
+	pos := uint64(0)
+	variable := false
+	for i := 0; ; i++ {
+		frame, err := stream.ParseNext()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return &InputParseError{Frame: i, Err: err}
+		}
+		if i == 0 {
+			variable, err = variableBlocking(stream, start)
+			if err != nil {
+				return err
+			}
+		}
+
+		// switch to next track
+		for track+1 < len(cue.Tracks) &&
+			(track < 0 || cue.Tracks[track+1].Start(stream.Info.SampleRate) <= pos+uint64(frame.BlockSize)/2) {
+			if m != nil {
+				err = flush()
+				if err != nil {
+					return err
+				}
+			}
+			track++
+			m = newTrack(stream.Info, album, cue, track, opts)
+			m.sources = []*source{{ra: stream}}
+		}
+
+		// update md5
+		frame.Hash(m.md5sum)
+
+		// get frame size
+		next, err := stream.Pos()
+		if err != nil {
+			return err
+		}
+
+		m.addFrame(scannedFrame{start, next, frame.Num, frame.BlockSize, variable})
+
+		// next iteration
+		start = next
+		pos += uint64(frame.BlockSize)
+	}
+	if m == nil {
+		return fmt.Errorf("no audio frames")
+	}
+	if track+1 < len(cue.Tracks) {
+		m.Close()
+		return fmt.Errorf("track %02d starts after the end of the image", cue.Tracks[track+1].Num)
+	}
+
+	return flush()
+}
+
+// newTrack returns an empty Merger for the i-th track of cue.
+func newTrack(info *meta.StreamInfo, album *Merger, cue *CueSheet, i int, opts Options) *Merger {
+	track := cue.Tracks[i]
+	opts.Fast = false
+	m := New(opts)
+	m.SampleRate = info.SampleRate
+	m.NChannels = info.NChannels
+	m.BitsPerSample = info.BitsPerSample
+
+	// tags
+	m.Album = album.Album
+	m.Artist = track.Performer
+	if m.Artist == "" {
+		m.Artist = album.Artist
+	}
+	m.Date = album.Date
+	m.Genre = album.Genre
+	m.Disc = cue.Disc
+	m.TotalDiscs = cue.TotalDiscs
+	if track.Songwriter == "" {
+		track.Songwriter = cue.Songwriter
+	}
+	if track.Composer == "" {
+		track.Composer = cue.Composer
+	}
+	if track.Comment == "" {
+		track.Comment = cue.Comment
+	}
+	m.Tags = [][2]string{
+		{"TITLE", track.Title},
+		{"TRACKNUMBER", strconv.Itoa(track.Num)},
+		{"TRACKTOTAL", strconv.Itoa(len(cue.Tracks))},
+		{"SONGWRITER", track.Songwriter},
+		{"COMPOSER", track.Composer},
+		{"ISRC", track.ISRC},
+		{"COMMENT", track.Comment},
+	}
+	m.Tracks = []Track{{
+		Title:      track.Title,
+		Performer:  m.Artist,
+		Songwriter: track.Songwriter,
+		ISRC:       track.ISRC,
+		Composer:   track.Composer,
+		Comment:    track.Comment,
+	}}
+	m.Pictures = album.Pictures
+	return m
+}
@@ -0,0 +1,143 @@
+package merge
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mewkiz/flac/meta"
+	"github.com/sdidyk/flac2one/flac"
+)
+
+// VerifyFile checks the FLAC file at path like Verify.
+func VerifyFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return &InputParseError{Path: path, Frame: -1, Err: err}
+	}
+	defer f.Close()
+	err = Verify(f)
+	if e, ok := err.(*VerificationError); ok {
+		e.Path = path
+	}
+	return err
+}
+
+// Verify decodes the FLAC stream of r and checks the CRC-8 and CRC-16 of
+// every frame, that sample numbers are contiguous, the number of samples and
+// MD5 sum against STREAMINFO (unless unknown), and that every seek point lies
+// on a frame boundary. Failed checks are VerificationError.
+func Verify(r io.ReadSeeker) error {
+	stream, err := flac.Parse(r)
+	if err != nil {
+		return invalid(-1, "%v", err)
+	}
+	var seekTable *meta.SeekTable
+	for _, block := range stream.Blocks {
+		if body, ok := block.Body.(*meta.SeekTable); ok {
+			seekTable = body
+		}
+	}
+
+	// get start offset
+	start, err := stream.Pos()
+	if err != nil {
+		return invalid(-1, "%v", err)
+	}
+	first := start
+
+	// check frames
+	md5sum := md5.New()
+	boundaries := make(map[uint64]uint64)
+	var sampleNum uint64
+	var raw []byte
+	variable := false
+	for i := uint64(0); ; i++ {
+		frame, err := stream.ParseNext()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return invalid(int(i), "%v", err)
+		}
+		frame.Hash(md5sum)
+
+		// get frame size
+		next, err := stream.Pos()
+		if err != nil {
+			return invalid(int(i), "%v", err)
+		}
+		if int64(cap(raw)) < next-start {
+			raw = make([]byte, next-start)
+		}
+		raw = raw[:next-start]
+		_, err = stream.ReadAt(raw, start)
+		if err != nil {
+			return invalid(int(i), "%v", err)
+		}
+
+		// check CRC
+		num, _, _, ok := parseFrameHeader(raw)
+		if !ok {
+			return invalid(int(i), "invalid header or CRC-8")
+		}
+		if !frameCRCValid(raw) {
+			return invalid(int(i), "invalid CRC-16")
+		}
+
+		// check sample number
+		if i == 0 {
+			variable = raw[1]&1 != 0
+		} else if variable != (raw[1]&1 != 0) {
+			return invalid(int(i), "blocking strategy changed")
+		}
+		if variable && num != sampleNum {
+			return invalid(int(i), "sample number %d, expected %d", num, sampleNum)
+		}
+		if !variable && num != i {
+			return invalid(int(i), "frame number %d", num)
+		}
+
+		boundaries[uint64(start-first)] = sampleNum
+		sampleNum += uint64(frame.BlockSize)
+
+		// next iteration
+		start = next
+	}
+
+	// check STREAMINFO
+	if stream.Info.NSamples != 0 && stream.Info.NSamples != sampleNum {
+		return invalid(-1, "number of samples mismatch; STREAMINFO %d, frames %d", stream.Info.NSamples, sampleNum)
+	}
+	var unknown [md5.Size]byte
+	if stream.Info.MD5sum != unknown && !bytes.Equal(stream.Info.MD5sum[:], md5sum.Sum(nil)) {
+		return invalid(-1, "MD5 sum mismatch; STREAMINFO %x, decoded %x", stream.Info.MD5sum, md5sum.Sum(nil))
+	}
+
+	// check seek points
+	if seekTable != nil {
+		for i, point := range seekTable.Points {
+			if point.SampleNum == placeholder {
+				continue
+			}
+			n, ok := boundaries[point.Offset]
+			if !ok {
+				return invalid(-1, "seek point %d: offset %d is not a frame boundary", i, point.Offset)
+			}
+			if n != point.SampleNum {
+				return invalid(-1, "seek point %d: sample %d, frame starts at %d", i, point.SampleNum, n)
+			}
+		}
+	}
+	return nil
+}
+
+// invalid returns a VerificationError of frame i.
+func invalid(i int, format string, args ...interface{}) error {
+	return &VerificationError{Frame: i, Err: fmt.Errorf(format, args...)}
+}
+
+// placeholder is the sample number of placeholder seek points.
+const placeholder = 0xFFFFFFFFFFFFFFFF
@@ -0,0 +1,47 @@
+package merge
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	a := newTestStream("One", 100000, 4096, 0)
+	b := newTestStream("Two", 50000, 1152, 100)
+	var out bytes.Buffer
+	if _, err := mergeTestStreams(t, Options{}, a, b).WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	data := out.Bytes()
+	if err := Verify(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(bytes.NewReader(a.data)); err != nil {
+		t.Errorf("fixed blocksize stream: %v", err)
+	}
+
+	// CRC-16 of last frame
+	broken := append([]byte(nil), data...)
+	broken[len(broken)-1] ^= 1
+	err := Verify(bytes.NewReader(broken))
+	var verifyErr *VerificationError
+	if !errors.As(err, &verifyErr) || verifyErr.Frame != 68 || !strings.Contains(err.Error(), "CRC-16") {
+		t.Errorf("expected CRC-16 error of frame 68, got %v", err)
+	}
+
+	// MD5 sum
+	broken = append([]byte(nil), data...)
+	broken[4+4+18] ^= 1
+	if err := Verify(bytes.NewReader(broken)); err == nil || !strings.Contains(err.Error(), "MD5") {
+		t.Errorf("expected MD5 error, got %v", err)
+	}
+
+	// seek point offset (first point of SEEKTABLE after STREAMINFO)
+	broken = append([]byte(nil), data...)
+	broken[4+4+34+4+8+7] ^= 1
+	if err := Verify(bytes.NewReader(broken)); err == nil || !strings.Contains(err.Error(), "seek point") {
+		t.Errorf("expected seek point error, got %v", err)
+	}
+}
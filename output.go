@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// pending holds the names of temporary files handled on interrupt: files
+// mapped to "" are removed, backups are renamed back to the mapped path.
+var pending = struct {
+	sync.Mutex
+	names map[string]string
+}{names: make(map[string]string)}
+
+// outputs are files written to temporary names in their directories and
+// renamed into place by commit.
+type outputs struct {
+	paths []string
+	files []*os.File
+}
+
+// create creates a temporary file which becomes path on commit.
+func (out *outputs) create(path string) (*os.File, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return nil, err
+	}
+	// TempFile creates files readable by owner only
+	err = f.Chmod(0644)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	pending.Lock()
+	pending.names[f.Name()] = ""
+	pending.Unlock()
+	out.paths = append(out.paths, path)
+	out.files = append(out.files, f)
+	return f, nil
+}
+
+// tempName returns the temporary name of path.
+func (out *outputs) tempName(path string) string {
+	for i, p := range out.paths {
+		if p == path {
+			return out.files[i].Name()
+		}
+	}
+	return path
+}
+
+// commit syncs the files and renames them into place. Replaced files are
+// kept under backup names until all files are renamed; if a rename fails,
+// the renames done are undone.
+func (out *outputs) commit() error {
+	for _, f := range out.files {
+		err := f.Sync()
+		if err != nil {
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	var backups []string
+	for i, f := range out.files {
+		backup := ""
+		if fi, err := os.Lstat(out.paths[i]); err == nil && fi.Mode().IsRegular() {
+			backup = f.Name() + ".old"
+			pending.Lock()
+			pending.names[backup] = out.paths[i]
+			pending.Unlock()
+			err = os.Rename(out.paths[i], backup)
+			if err != nil {
+				pending.Lock()
+				delete(pending.names, backup)
+				pending.Unlock()
+				return out.rollback(err, i, backups)
+			}
+		}
+		backups = append(backups, backup)
+		err := os.Rename(f.Name(), out.paths[i])
+		if err != nil {
+			return out.rollback(err, i, backups)
+		}
+	}
+	pending.Lock()
+	for i, f := range out.files {
+		delete(pending.names, f.Name())
+		delete(pending.names, backups[i])
+	}
+	pending.Unlock()
+	err := out.syncDirs()
+	for _, backup := range backups {
+		if backup != "" {
+			os.Remove(backup)
+		}
+	}
+	out.paths, out.files = nil, nil
+	return err
+}
+
+// rollback moves the first n files renamed by commit back to their temporary
+// names and restores the files they replaced. It returns err with the files
+// which could not be restored.
+func (out *outputs) rollback(err error, n int, backups []string) error {
+	pending.Lock()
+	defer pending.Unlock()
+	var failed []string
+	for i, backup := range backups {
+		if i < n && os.Rename(out.paths[i], out.files[i].Name()) != nil ||
+			backup != "" && os.Rename(backup, out.paths[i]) != nil {
+			if backup != "" {
+				failed = append(failed, fmt.Sprintf("%s (original kept as %s)", out.paths[i], backup))
+			} else {
+				failed = append(failed, out.paths[i])
+			}
+			continue
+		}
+		delete(pending.names, backup)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%v; could not restore %s", err, strings.Join(failed, ", "))
+	}
+	return fmt.Errorf("%v; no files moved", err)
+}
+
+// syncDirs syncs the directories of the files so that renames are durable.
+func (out *outputs) syncDirs() error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	done := make(map[string]bool)
+	for _, path := range out.paths {
+		dir := filepath.Dir(path)
+		if done[dir] {
+			continue
+		}
+		done[dir] = true
+		d, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		err = d.Sync()
+		d.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanup removes the files which are not committed.
+func (out *outputs) cleanup() {
+	pending.Lock()
+	defer pending.Unlock()
+	for _, f := range out.files {
+		f.Close()
+		if _, ok := pending.names[f.Name()]; ok {
+			os.Remove(f.Name())
+			delete(pending.names, f.Name())
+		}
+	}
+	out.paths, out.files = nil, nil
+}
+
+// handleSignals removes all temporary files, restores replaced files and
+// exits on interrupt.
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		pending.Lock()
+		removePending()
+		fmt.Printf("Interrupted by %v\n", sig)
+		os.Exit(130)
+	}()
+}
+
+// removePending removes the temporary files and restores the backups in
+// pending. The caller holds its lock.
+func removePending() {
+	for name, path := range pending.names {
+		if path != "" {
+			os.Rename(name, path)
+		} else {
+			os.Remove(name)
+		}
+		delete(pending.names, name)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writeOutput creates path in out with data.
+func writeOutput(t *testing.T, out *outputs, path, data string) {
+	f, err := out.create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkDir checks the names and the contents of the files in dir.
+func checkDir(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names, wantNames []string
+	for _, fi := range list {
+		names = append(names, fi.Name())
+	}
+	for name := range want {
+		wantNames = append(wantNames, name)
+	}
+	sort.Strings(wantNames)
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("got files %v, want %v", names, wantNames)
+	}
+	for name, data := range want {
+		if data == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != data {
+			t.Errorf("%s: got %q, want %q", name, b, data)
+		}
+	}
+	pending.Lock()
+	defer pending.Unlock()
+	if len(pending.names) > 0 {
+		t.Errorf("pending files left: %v", pending.names)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.flac"), filepath.Join(dir, "a.cue")
+	if err := ioutil.WriteFile(a, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out outputs
+	defer out.cleanup()
+	writeOutput(t, &out, a, "new")
+	writeOutput(t, &out, b, "cue")
+	if err := out.commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkDir(t, dir, map[string]string{"a.flac": "new", "a.cue": "cue"})
+}
+
+func TestCommitRollback(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.flac"), filepath.Join(dir, "a.cue")
+	if err := ioutil.WriteFile(a, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// renaming a file over a non-empty directory fails
+	if err := os.MkdirAll(filepath.Join(b, "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var out outputs
+	writeOutput(t, &out, a, "new")
+	writeOutput(t, &out, b, "cue")
+	if err := out.commit(); err == nil {
+		t.Fatal("commit over a directory succeeded")
+	}
+	out.cleanup()
+	checkDir(t, dir, map[string]string{"a.flac": "old", "a.cue": ""})
+}
+
+func TestCleanup(t *testing.T) {
+	dir := t.TempDir()
+	var out outputs
+	writeOutput(t, &out, filepath.Join(dir, "a.flac"), "new")
+	out.cleanup()
+	checkDir(t, dir, nil)
+}
+
+func TestRemovePending(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.flac")
+	if err := ioutil.WriteFile(a, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// interrupt after the first file replaced a
+	var out outputs
+	writeOutput(t, &out, a, "new")
+	writeOutput(t, &out, filepath.Join(dir, "a.cue"), "cue")
+	backup := out.files[0].Name() + ".old"
+	if err := os.Rename(a, backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(out.files[0].Name(), a); err != nil {
+		t.Fatal(err)
+	}
+	pending.Lock()
+	pending.names[backup] = a
+	removePending()
+	pending.Unlock()
+	for _, f := range out.files {
+		f.Close()
+	}
+	checkDir(t, dir, map[string]string{"a.flac": "old"})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sdidyk/flac2one/merge"
+)
+
+func splitFiles() int {
+	var inputs []string
+	for _, path := range flag.Args() {
+		if !*flagSilent {
+			fmt.Printf("Splitting: %s\n", path)
+		}
+		image, err := split(path)
+		if err != nil {
+			fmt.Println(err)
+			return exitCode(err, 3)
+		}
+		inputs = append(inputs, path, image)
+	}
+
+	// delete files
+	return deleteInputs(inputs)
+}
+
+// split writes one FLAC file per track of the CUE-sheet at path. It returns
+// the path of the FLAC image.
+func split(path string) (image string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	cue, err := merge.ParseCue(f)
+	f.Close()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+
+	// open image
+	image = cueImagePath(path, cue.File)
+	r, err := os.Open(image)
+	if err != nil {
+		return image, err
+	}
+	defer r.Close()
+
+	err = merge.Split(r, cue, merge.Options{SeekTable: seekTable, Padding: padding, TagsFirst: *flagTagsFirst}, func(track merge.CueTrack, m *merge.Merger) error {
+		// generate file name
+		filename := fmt.Sprintf("%s/%02d. %s", *flagOutputDir, track.Num, quoteFilename(track.Title))
+
+		if !*flagSilent {
+			fmt.Printf("Writing to \"%s.flac\"\n", filename)
+		}
+
+		return writeFlac(fmt.Sprintf("%s.flac", filename), m)
+	})
+	if err != nil {
+		return image, fmt.Errorf("%s: %w", image, err)
+	}
+	return image, nil
+}
+
+// cueImagePath locates the FILE of a CUE-sheet. Relative names are looked up
+// next to the CUE-sheet first, then in the current directory.
+func cueImagePath(cuePath, file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	dir := filepath.Dir(cuePath)
+	for _, path := range []string{
+		filepath.Join(dir, file),
+		file,
+		filepath.Join(dir, filepath.Base(file)),
+	} {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(dir, file)
+}
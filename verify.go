@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sdidyk/flac2one/merge"
+)
+
+func verifyFiles(paths []string) int {
+	code := 0
+	for _, path := range paths {
+		err := merge.VerifyFile(path)
+		if err != nil {
+			fmt.Println(err)
+			code = exitCode(err, 5)
+		} else if !*flagSilent {
+			fmt.Printf("%s: OK\n", path)
+		}
+	}
+	return code
+}